@@ -0,0 +1,67 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"net/url"
+	"os"
+
+	"github.com/mercul3s/placechicken/placer"
+)
+
+// assets holds the templates, static files and starter chickens compiled
+// into the binary, so it runs from any working directory.
+//
+//go:embed templates static/css static/images/place_chicken.png static/images/starter
+var assets embed.FS
+
+// starterSource is the image source used when none is configured.
+const starterSource = "embed://"
+
+func init() {
+	placer.RegisterBackend("embed", embedBackend)
+}
+
+// embedBackend serves embed:// sources from the starter library compiled into
+// the binary.
+func embedBackend(u *url.URL) (placer.Directory, string, error) {
+	starter, err := fs.Sub(assets, "static/images/starter")
+	if err != nil {
+		return nil, "", err
+	}
+	p := u.Host + u.Path
+	if p == "" || p == "/" {
+		p = "."
+	}
+	return &placer.FS{FS: starter}, p, nil
+}
+
+// assetFS returns the embedded directory dir, with files in the on-disk
+// override directory, when set, taking precedence.
+func assetFS(dir string, override string) fs.FS {
+	embedded, err := fs.Sub(assets, dir)
+	if err != nil {
+		// dir is one of the embedded directories, so this can't happen
+		panic(err)
+	}
+	if override == "" {
+		return embedded
+	}
+	return overlayFS{os.DirFS(override), embedded}
+}
+
+// overlayFS opens each name from the first file system that has it.
+type overlayFS []fs.FS
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	var err error
+	for _, layer := range o {
+		var f fs.File
+		f, err = layer.Open(name)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return f, err
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mercul3s/placechicken/placer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssetFSOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "placechicken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("custom index"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	templates := assetFS("templates", dir)
+	index, err := fs.ReadFile(templates, "index.html")
+	assert.Nil(t, err)
+	assert.Equal(t, "custom index", string(index))
+	chicken, err := fs.ReadFile(templates, "chicken")
+	assert.Nil(t, err, "files missing on disk should come from the binary")
+	assert.Contains(t, string(chicken), "( a )")
+
+	_, err = fs.ReadFile(templates, "missing")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStarterLibrary(t *testing.T) {
+	d, p, err := placer.OpenSource(starterSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lib, err := d.Library(p)
+	assert.Nil(t, err)
+	assert.NotEqual(t, 0, len(lib.Images()))
+}
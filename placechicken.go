@@ -1,25 +1,302 @@
 package main
 
 import (
+	"errors"
+	"image"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/mercul3s/placechicken/placer"
 	"github.com/mercul3s/placechicken/router"
 )
 
+// Default cache limits, in bytes, used when the matching variables are unset.
+const (
+	defaultCacheBytes     = 512 << 20
+	defaultSourceBytes    = 256 << 20
+	defaultRenditionBytes = 64 << 20
+)
+
+// defaultPollInterval is how often the image library is checked for changes
+// when LIBRARY_POLL is unset.
+const defaultPollInterval = 30 * time.Second
+
 var logger = log.New(os.Stdout, "placechicken:", log.Lshortfile)
 
 func main() {
-	static := os.Getenv("STATIC")
 	resized := os.Getenv("RESIZED")
-	d := placer.Dir{}
-	p := placer.Config(&d, static, resized)
-	logger.Printf("placechicken started with directories static: %s and resized: %s", static, resized)
-	m := router.NewMux(p, "static/", "templates/")
-	err := http.ListenAndServe(":8888", m.Router)
+	if resized == "" {
+		resized = filepath.Join(os.TempDir(), "placechicken")
+	}
+	cols, def := collections(resized)
+	mem := placer.NewMemCache(
+		envBytes("MEMORY_SOURCE_BYTES", defaultSourceBytes),
+		envBytes("MEMORY_RENDITION_BYTES", defaultRenditionBytes),
+	)
+	fallback, err := placer.ParseFallback(os.Getenv("FALLBACK"))
+	if err != nil {
+		logger.Fatalf("invalid FALLBACK: %s", err)
+	}
+	marks := watermarks()
+	forced := collectionWatermarks(cols, marks)
+	libs := &libraries{poll: envDuration("LIBRARY_POLL", defaultPollInterval)}
+	places := map[string]placer.Place{}
+	// the collections share CACHE_MAX_BYTES, each caching under its own
+	// directory
+	cacheBytes := envBytes("CACHE_MAX_BYTES", defaultCacheBytes) / int64(len(cols))
+	for _, c := range cols {
+		p := openCollection(c, cacheBytes, fallback != nil, libs)
+		p.Memory = mem
+		p.Watermarks = marks
+		p.Watermark = forced[c.name]
+		p.Fallback = fallback
+		places[c.name] = p
+	}
+	go libs.reloadOnHangup()
+	m := router.NewCollectionsMux(places, def,
+		assetFS("static", os.Getenv("STATIC_DIR")),
+		assetFS("templates", os.Getenv("TEMPLATES_DIR")),
+	)
+	err = http.ListenAndServe(":8888", m.Router)
 	if err != nil {
 		logger.Print(err)
 	}
 }
+
+// collection is a named image source and where its renditions are cached.
+type collection struct {
+	name    string
+	source  string
+	resized string
+}
+
+// collections reads the image sources to serve and the name of the default
+// one. COLLECTIONS lists them as comma separated name=source pairs, each
+// cached in its own directory under resized, with DEFAULT_COLLECTION or else
+// the first one served on the unprefixed paths. Without it a single
+// collection is served from IMAGES_SOURCE.
+func collections(resized string) ([]collection, string) {
+	v := os.Getenv("COLLECTIONS")
+	if v == "" {
+		// IMAGES_SOURCE picks the backend by URL scheme; STATIC is still
+		// honoured as a plain directory path
+		source := os.Getenv("IMAGES_SOURCE")
+		if source == "" {
+			source = os.Getenv("STATIC")
+		}
+		if source == "" {
+			source = starterSource
+		}
+		return []collection{{name: router.DefaultCollection, source: source, resized: resized}}, router.DefaultCollection
+	}
+	cols := []collection{}
+	seen := map[string]bool{}
+	for _, pair := range strings.Split(v, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" || strings.ContainsAny(kv[0], `/\`) {
+			logger.Fatalf("invalid COLLECTIONS entry %q, expected name=source", pair)
+		}
+		if seen[kv[0]] {
+			logger.Fatalf("collection %s is listed twice in COLLECTIONS", kv[0])
+		}
+		seen[kv[0]] = true
+		cols = append(cols, collection{name: kv[0], source: kv[1], resized: filepath.Join(resized, kv[0])})
+	}
+	def := os.Getenv("DEFAULT_COLLECTION")
+	if def == "" {
+		def = cols[0].name
+	}
+	if !seen[def] {
+		logger.Fatalf("DEFAULT_COLLECTION %s isn't one of COLLECTIONS", def)
+	}
+	return cols, def
+}
+
+// watermarks loads the overlays listed in WATERMARKS as comma separated
+// name=path pairs, which requests pick with ?watermark=name.
+func watermarks() map[string]image.Image {
+	marks := map[string]image.Image{}
+	v := os.Getenv("WATERMARKS")
+	if v == "" {
+		return marks
+	}
+	for _, pair := range strings.Split(v, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" || strings.ContainsAny(kv[0], `/\`) {
+			logger.Fatalf("invalid WATERMARKS entry %q, expected name=path", pair)
+		}
+		img, err := placer.LoadWatermark(kv[1])
+		if err != nil {
+			logger.Fatalf("unable to load watermark %s: %s", kv[0], err)
+		}
+		marks[kv[0]] = img
+	}
+	return marks
+}
+
+// collectionWatermarks reads the watermarks forced on collections from
+// COLLECTION_WATERMARKS, comma separated entries giving a collection and the
+// watermark parameters of a request, such as
+// demo?watermark=placeholder&watermark_tile.
+func collectionWatermarks(cols []collection, marks map[string]image.Image) map[string]*placer.Watermark {
+	forced := map[string]*placer.Watermark{}
+	v := os.Getenv("COLLECTION_WATERMARKS")
+	if v == "" {
+		return forced
+	}
+	names := map[string]bool{}
+	for _, c := range cols {
+		names[c.name] = true
+	}
+	for _, entry := range strings.Split(v, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "?", 2)
+		if len(parts) != 2 || !names[parts[0]] {
+			logger.Fatalf("invalid COLLECTION_WATERMARKS entry %q, expected collection?watermark=name", entry)
+		}
+		q, err := url.ParseQuery(parts[1])
+		if err != nil {
+			logger.Fatalf("invalid COLLECTION_WATERMARKS entry %q: %s", entry, err)
+		}
+		wm, err := placer.ParseWatermark(q, marks)
+		if err == nil && wm == nil {
+			err = errors.New("no watermark given")
+		}
+		if err != nil {
+			logger.Fatalf("invalid COLLECTION_WATERMARKS entry %q: %s", entry, err)
+		}
+		forced[parts[0]] = wm
+	}
+	return forced
+}
+
+// openCollection indexes a collection's images and sets up its rendition
+// cache of up to cacheBytes, keeping the index up to date in the background.
+// With tolerant set, a collection that can't be indexed yet is still served,
+// and indexing is retried in the background until it succeeds.
+func openCollection(c collection, cacheBytes int64, tolerant bool, libs *libraries) placer.Place {
+	d, static, err := placer.OpenSource(c.source)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if dir, ok := d.(*placer.Dir); ok {
+		// renditions are often cached under the originals
+		dir.Exclude = append(dir.Exclude, c.resized)
+	}
+	p := placer.Config(d, static, c.resized)
+	cache, err := placer.NewDiskCache(c.resized, cacheBytes)
+	if err != nil {
+		logger.Fatalf("unable to create resized image cache: %s", err)
+	}
+	p.Cache = cache
+	lib, err := d.Library(static)
+	if err != nil && tolerant {
+		logger.Printf("unable to index images in %s, serving fallbacks for now: %s", c.source, err)
+		go libs.indexLater(c, d, static)
+		return p
+	}
+	if err != nil {
+		logger.Fatalf("unable to index images in %s: %s", c.source, err)
+	}
+	libs.watch(c.name, lib)
+	logger.Printf("collection %s started with %d images from %s and resized: %s", c.name, len(lib.Images()), c.source, c.resized)
+	return p
+}
+
+// libraries are the indexes of the collections being served, kept up to
+// date in the background.
+type libraries struct {
+	poll time.Duration
+
+	mu   sync.Mutex
+	libs []*placer.Library
+}
+
+// watch reloads lib on SIGHUP and, if it can tell when its backend changed,
+// polls it for changes. Backends that can't, such as S3, would be listed in
+// full on every poll, and are left to their TTL instead.
+func (ls *libraries) watch(name string, lib *placer.Library) {
+	if lib.Watchable() {
+		go lib.Poll(ls.poll, nil, func(err error) {
+			logger.Printf("unable to refresh %s image library: %s", name, err)
+		})
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.libs = append(ls.libs, lib)
+}
+
+// indexLater retries indexing a collection every poll interval until it
+// succeeds, or a request has indexed it meanwhile, and then watches it.
+func (ls *libraries) indexLater(c collection, d placer.Directory, path string) {
+	t := time.NewTicker(ls.poll)
+	defer t.Stop()
+	for range t.C {
+		lib, err := d.Library(path)
+		if err != nil {
+			continue
+		}
+		ls.watch(c.name, lib)
+		logger.Printf("collection %s indexed with %d images from %s", c.name, len(lib.Images()), c.source)
+		return
+	}
+}
+
+// watched returns the libraries being watched.
+func (ls *libraries) watched() []*placer.Library {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return append([]*placer.Library(nil), ls.libs...)
+}
+
+// envBytes reads a byte count from the environment, falling back to def when
+// the variable is unset.
+func envBytes(name string, def int64) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		logger.Fatalf("invalid %s %q: %s", name, v, err)
+	}
+	return n
+}
+
+// envDuration reads a duration such as "30s" from the environment, falling
+// back to def when the variable is unset.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		logger.Fatalf("invalid %s %q: %s", name, v, err)
+	}
+	return d
+}
+
+// reloadOnHangup rebuilds the library indexes whenever the process gets
+// SIGHUP.
+func (ls *libraries) reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		for _, lib := range ls.watched() {
+			if err := lib.Reload(); err != nil {
+				logger.Printf("unable to reload image library %s: %s", lib.Path, err)
+				continue
+			}
+			logger.Printf("reloaded image library %s with %d images", lib.Path, len(lib.Images()))
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/mercul3s/placechicken/placer"
+	"github.com/mercul3s/placechicken/router"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollections(t *testing.T) {
+	t.Setenv("COLLECTIONS", "")
+	t.Setenv("IMAGES_SOURCE", "file://./static/images/test/")
+	cols, def := collections("/resized")
+	assert.Equal(t, []collection{{name: router.DefaultCollection, source: "file://./static/images/test/", resized: "/resized"}}, cols)
+	assert.Equal(t, router.DefaultCollection, def)
+
+	t.Setenv("COLLECTIONS", "chickens=file://./static/images/test/, ducks=s3://bucket/ducks/?region=eu-west-1")
+	cols, def = collections("/resized")
+	assert.Equal(t, []collection{
+		{name: "chickens", source: "file://./static/images/test/", resized: filepath.Join("/resized", "chickens")},
+		{name: "ducks", source: "s3://bucket/ducks/?region=eu-west-1", resized: filepath.Join("/resized", "ducks")},
+	}, cols)
+	assert.Equal(t, "chickens", def, "the first collection is the default")
+
+	t.Setenv("DEFAULT_COLLECTION", "ducks")
+	_, def = collections("/resized")
+	assert.Equal(t, "ducks", def)
+}
+
+func TestWatermarks(t *testing.T) {
+	t.Setenv("WATERMARKS", "")
+	assert.Empty(t, watermarks())
+
+	t.Setenv("WATERMARKS", "logo=./static/images/test/original-test-image.jpg")
+	marks := watermarks()
+	if assert.Contains(t, marks, "logo") {
+		assert.Equal(t, 2160, marks["logo"].Bounds().Dx())
+	}
+
+	cols := []collection{{name: "chickens"}, {name: "ducks"}}
+	t.Setenv("COLLECTION_WATERMARKS", "ducks?watermark=logo&watermark_tile&watermark_opacity=0.25")
+	forced := collectionWatermarks(cols, marks)
+	assert.Nil(t, forced["chickens"])
+	if assert.NotNil(t, forced["ducks"]) {
+		assert.Equal(t, "logo", forced["ducks"].Name)
+		assert.True(t, forced["ducks"].Tile)
+		assert.Equal(t, 0.25, forced["ducks"].Opacity)
+		assert.Equal(t, imaging.BottomRight, forced["ducks"].Position)
+	}
+}
+
+func TestIndexLater(t *testing.T) {
+	lib := placer.MockLibrary("chickens", placer.Image{Name: "original-a.jpg"})
+	d := &placer.MockDir{}
+	d.On("Library", "chickens").Return((*placer.Library)(nil), errors.New("backend down")).Once()
+	d.On("Library", "chickens").Return(lib, nil)
+	libs := &libraries{poll: time.Millisecond}
+	libs.indexLater(collection{name: "chickens"}, d, "chickens")
+	assert.Equal(t, []*placer.Library{lib}, libs.watched(), "a library indexed late is watched")
+	d.AssertNumberOfCalls(t, "Library", 2)
+}
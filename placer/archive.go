@@ -0,0 +1,354 @@
+package placer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Archive serves originals straight out of a .zip, .tar or .tar.gz file, so
+// a library can be shipped as a single artifact. Paths handed to it are the
+// archive's location on disk. Each archive is indexed once, and members are
+// read on demand.
+type Archive struct {
+	libraries
+	mu      sync.Mutex
+	indexes map[string]*archiveIndex
+	// staged holds the indexes built by reloads in progress, which are only
+	// published once the reload succeeds.
+	staged map[string]*archiveIndex
+}
+
+// archiveIndex maps member names to functions that open them.
+type archiveIndex struct {
+	// closer is the archive file held open for reading members, if any.
+	closer  io.Closer
+	members map[string]func() (io.ReadCloser, error)
+	// readers counts the members being read and retired is set once the
+	// index is replaced, both guarded by Archive.mu. A retired index is
+	// closed when its last reader is done.
+	readers int
+	retired bool
+}
+
+// Library returns the index of images in an archive, building it on first
+// use. Dimensions are read from each member's header while indexing. The
+// index notices the archive being replaced through its modification time.
+func (a *Archive) Library(p string) (*Library, error) {
+	return a.libraries.get(p, func(p string) *Library {
+		l := NewLibrary(p, a.list)
+		l.modTime = statModTime
+		l.open = func(p string, i Image) (io.ReadCloser, error) {
+			return a.open(p, i, true)
+		}
+		l.commit = a.commit
+		return l
+	})
+}
+
+// Open reads an image out of the archive.
+func (a *Archive) Open(p string, i Image) (io.ReadCloser, error) {
+	return a.open(p, i, false)
+}
+
+// open reads a member out of the published index or, with staged set, out of
+// the one a reload is building, if any.
+func (a *Archive) open(p string, i Image, staged bool) (io.ReadCloser, error) {
+	a.mu.Lock()
+	idx := a.indexes[p]
+	if s := a.staged[p]; staged && s != nil {
+		idx = s
+	}
+	if idx != nil {
+		idx.readers++
+	}
+	a.mu.Unlock()
+	if idx == nil {
+		return nil, fmt.Errorf("archive %s has not been indexed", p)
+	}
+	open, ok := idx.members[i.Name]
+	if !ok {
+		a.release(idx)
+		return nil, fmt.Errorf("open %s in %s: %s", i.Name, p, os.ErrNotExist)
+	}
+	rc, err := open()
+	if err != nil {
+		a.release(idx)
+		return nil, err
+	}
+	return &archiveReader{ReadCloser: rc, done: func() { a.release(idx) }}, nil
+}
+
+// archiveReader releases its index once closed.
+type archiveReader struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (r *archiveReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.done)
+	return err
+}
+
+// release is called when a reader of idx is done.
+func (a *Archive) release(idx *archiveIndex) {
+	a.mu.Lock()
+	idx.readers--
+	idle := idx.retired && idx.readers == 0
+	a.mu.Unlock()
+	if idle && idx.closer != nil {
+		idx.closer.Close()
+	}
+}
+
+// retire marks idx as replaced, closing it now if nothing is reading it.
+func (a *Archive) retire(idx *archiveIndex) {
+	a.mu.Lock()
+	idx.retired = true
+	idle := idx.readers == 0
+	a.mu.Unlock()
+	if idle && idx.closer != nil {
+		idx.closer.Close()
+	}
+}
+
+// commit publishes the index staged for p once its reload has succeeded,
+// retiring the one it replaces, or discards it if the reload failed.
+func (a *Archive) commit(p string, err error) {
+	a.mu.Lock()
+	staged := a.staged[p]
+	delete(a.staged, p)
+	old := staged
+	if err == nil && staged != nil {
+		if a.indexes == nil {
+			a.indexes = map[string]*archiveIndex{}
+		}
+		old = a.indexes[p]
+		a.indexes[p] = staged
+	}
+	a.mu.Unlock()
+	if old != nil {
+		a.retire(old)
+	}
+}
+
+func (a *Archive) list(p string) ([]Image, error) {
+	var idx *archiveIndex
+	var i []Image
+	var err error
+	name := strings.ToLower(p)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		idx, i, err = indexZip(p)
+	case strings.HasSuffix(name, ".tar"):
+		idx, i, err = indexTar(p)
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		idx, i, err = indexTarGz(p)
+	default:
+		err = fmt.Errorf("unsupported archive %s, expected .zip, .tar or .tar.gz", p)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// staged until the reload succeeds, so a failed one doesn't replace the
+	// index being served
+	a.mu.Lock()
+	old := a.staged[p]
+	if a.staged == nil {
+		a.staged = map[string]*archiveIndex{}
+	}
+	a.staged[p] = idx
+	a.mu.Unlock()
+	if old != nil {
+		a.retire(old)
+	}
+	return i, nil
+}
+
+// isOriginal applies the usual "original" naming filter to an archive member.
+func isOriginal(name string) bool {
+	return strings.Contains(path.Base(name), "original")
+}
+
+func indexZip(p string) (*archiveIndex, []Image, error) {
+	r, err := zip.OpenReader(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	idx := &archiveIndex{closer: r, members: map[string]func() (io.ReadCloser, error){}}
+	i := []Image{}
+	for _, f := range r.File {
+		if f.Name == MetadataFile {
+			idx.members[f.Name] = f.Open
+		}
+		if f.FileInfo().IsDir() || !isOriginal(f.Name) {
+			continue
+		}
+		idx.members[f.Name] = f.Open
+		img := Image{
+			Name:    f.Name,
+			Size:    int64(f.UncompressedSize64),
+			ModTime: f.Modified,
+			Tags:    dirTags(f.Name),
+		}
+		if rc, err := f.Open(); err == nil {
+			decodeSize(&img, rc)
+			rc.Close()
+		}
+		i = append(i, img)
+	}
+	return idx, i, nil
+}
+
+// countingReader tracks how far into an uncompressed tar we have read, which
+// is where the data of the member just returned by Next starts.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func indexTar(p string) (*archiveIndex, []Image, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	cr := &countingReader{r: f}
+	tr := tar.NewReader(cr)
+	idx := &archiveIndex{closer: f, members: map[string]func() (io.ReadCloser, error){}}
+	i := []Image{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg || (!isOriginal(hdr.Name) && hdr.Name != MetadataFile) {
+			continue
+		}
+		section := io.NewSectionReader(f, cr.n, hdr.Size)
+		idx.members[hdr.Name] = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(io.NewSectionReader(section, 0, section.Size())), nil
+		}
+		if hdr.Name != MetadataFile {
+			img := tarImage(hdr)
+			decodeSize(&img, tr)
+			i = append(i, img)
+		}
+	}
+	return idx, i, nil
+}
+
+// indexTarGz indexes a compressed tar. Members can't be seeked to, so opening
+// one decompresses the archive up to it.
+func indexTarGz(p string) (*archiveIndex, []Image, error) {
+	idx := &archiveIndex{members: map[string]func() (io.ReadCloser, error){}}
+	i := []Image{}
+	err := scanTarGz(p, func(hdr *tar.Header, r io.Reader) bool {
+		if hdr.Typeflag != tar.TypeReg || (!isOriginal(hdr.Name) && hdr.Name != MetadataFile) {
+			return true
+		}
+		name := hdr.Name
+		idx.members[name] = func() (io.ReadCloser, error) {
+			return openTarGzMember(p, name)
+		}
+		if name != MetadataFile {
+			img := tarImage(hdr)
+			decodeSize(&img, r)
+			i = append(i, img)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return idx, i, nil
+}
+
+// scanTarGz calls fn for each member of a compressed tar until fn returns
+// false.
+func scanTarGz(p string, fn func(*tar.Header, io.Reader) bool) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !fn(hdr, tr) {
+			return nil
+		}
+	}
+}
+
+func openTarGzMember(p string, name string) (io.ReadCloser, error) {
+	var data []byte
+	var readErr error
+	found := false
+	err := scanTarGz(p, func(hdr *tar.Header, r io.Reader) bool {
+		if hdr.Name != name {
+			return true
+		}
+		found = true
+		data, readErr = ioutil.ReadAll(r)
+		return false
+	})
+	if err == nil {
+		err = readErr
+	}
+	if err == nil && !found {
+		err = fmt.Errorf("open %s in %s: %s", name, p, os.ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// decodeSize sets the image's dimensions from the header at the start of r,
+// leaving them unset if it can't be decoded.
+func decodeSize(i *Image, r io.Reader) {
+	if c, _, err := image.DecodeConfig(io.LimitReader(r, headerBytes)); err == nil {
+		i.Width, i.Height = c.Width, c.Height
+	}
+}
+
+func tarImage(hdr *tar.Header) Image {
+	return Image{
+		Name:    hdr.Name,
+		Size:    hdr.Size,
+		ModTime: hdr.ModTime,
+		Tags:    dirTags(hdr.Name),
+	}
+}
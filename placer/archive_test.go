@@ -0,0 +1,197 @@
+package placer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var archiveMembers = []struct {
+	name string
+	body string
+}{
+	{name: "original-1.jpg", body: "one"},
+	{name: "README", body: "not a chicken"},
+	{name: "chicks/original-2.jpg", body: "two"},
+	{name: "resized/chicken-300x200.jpg", body: "resized"},
+	{name: "original-3.png", body: encodePNG(3, 2)},
+}
+
+func encodePNG(w int, h int) string {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h)))
+	return buf.String()
+}
+
+func writeZip(t *testing.T, p string) {
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, m := range archiveMembers {
+		w, err := zw.Create(m.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, m.body)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTar(t *testing.T, p string, compress bool) {
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var w io.Writer = f
+	if compress {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	for _, m := range archiveMembers {
+		hdr := &tar.Header{Name: m.name, Mode: 0644, Size: int64(len(m.body)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(tw, m.body)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "placechicken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeZip(t, filepath.Join(dir, "chickens.zip"))
+	writeTar(t, filepath.Join(dir, "chickens.tar"), false)
+	writeTar(t, filepath.Join(dir, "chickens.tar.gz"), true)
+
+	for _, name := range []string{"chickens.zip", "chickens.tar", "chickens.tar.gz"} {
+		t.Run(name, func(t *testing.T) {
+			p := filepath.Join(dir, name)
+			a := Archive{}
+			lib, err := a.Library(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			images := lib.Images()
+			if !assert.Equal(t, 3, len(images)) {
+				return
+			}
+			assert.Equal(t, "chicks/original-2.jpg", images[0].Name)
+			assert.Equal(t, "original-1.jpg", images[1].Name)
+			assert.Equal(t, int64(3), images[1].Size)
+			assert.Equal(t, 0, images[1].Width, "members that aren't images have no dimensions")
+			assert.Equal(t, "original-3.png", images[2].Name)
+			assert.Equal(t, []int{3, 2}, []int{images[2].Width, images[2].Height}, "dimensions are read while indexing")
+
+			for i, body := range []string{"two", "one"} {
+				rc, err := a.Open(p, images[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := ioutil.ReadAll(rc)
+				rc.Close()
+				assert.Nil(t, err)
+				assert.Equal(t, body, string(data))
+			}
+
+			_, err = a.Open(p, Image{Name: "README"})
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestArchiveReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "placechicken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "chickens.zip")
+	// archives are replaced by renaming, so open files keep the old one
+	replace := func(members map[string]string) {
+		tmp := p + ".tmp"
+		f, err := os.Create(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw := zip.NewWriter(f)
+		for name, body := range members {
+			w, _ := zw.Create(name)
+			io.WriteString(w, body)
+		}
+		zw.Close()
+		f.Close()
+		if err := os.Rename(tmp, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(rc io.ReadCloser, err error) string {
+		if err != nil {
+			return err.Error()
+		}
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return err.Error()
+		}
+		return string(data)
+	}
+	replace(map[string]string{"original-1.jpg": "one"})
+	a := Archive{}
+	lib, err := a.Library(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reading, err := a.Open(p, Image{Name: "original-1.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replace(map[string]string{"original-1.jpg": "uno", MetadataFile: "{"})
+	assert.NotNil(t, lib.Reload(), "a malformed sidecar fails the reload")
+	assert.Equal(t, "one", read(a.Open(p, Image{Name: "original-1.jpg"})), "a failed reload keeps serving the old archive")
+
+	replace(map[string]string{"original-1.jpg": "uno"})
+	assert.Nil(t, lib.Reload())
+	assert.Equal(t, "uno", read(a.Open(p, Image{Name: "original-1.jpg"})))
+	assert.Equal(t, "one", read(reading, nil), "readers of the old archive can finish")
+	assert.Empty(t, a.staged)
+}
+
+func TestArchiveErrors(t *testing.T) {
+	a := Archive{}
+	_, err := randImg(&a, "chickens.rar")
+	assert.Contains(t, err.Error(), "unsupported archive")
+	_, err = randImg(&a, "missing.zip")
+	assert.NotNil(t, err)
+	_, err = a.Open("missing.zip", Image{Name: "original-1.jpg"})
+	assert.NotNil(t, err)
+
+	d, p, err := OpenSource("zip://./chickens.zip")
+	assert.Nil(t, err)
+	assert.IsType(t, &Archive{}, d)
+	assert.Equal(t, "./chickens.zip", p)
+}
@@ -0,0 +1,172 @@
+package placer
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backend builds a Directory for an image source URL. It returns the
+// Directory along with the path to hand to its methods.
+type Backend func(u *url.URL) (Directory, string, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]Backend{
+		"file":  fileBackend,
+		"s3":    s3Backend,
+		"http":  httpBackend,
+		"https": httpBackend,
+		"zip":   archiveBackend,
+		"tar":   archiveBackend,
+	}
+)
+
+// RegisterBackend makes a Backend available for image sources with the given
+// URL scheme, replacing any Backend already registered for it.
+func RegisterBackend(scheme string, b Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[scheme] = b
+}
+
+// OpenSource builds the Directory for an image source such as
+// file://./static/images/ or s3://bucket/chickens/. A source without a scheme
+// is treated as a local path.
+func OpenSource(source string) (Directory, string, error) {
+	if !strings.Contains(source, "://") {
+		return &Dir{}, source, nil
+	}
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid image source %q: %s", source, err)
+	}
+
+	backendsMu.RLock()
+	b, ok := backends[u.Scheme]
+	schemes := []string{}
+	for scheme := range backends {
+		schemes = append(schemes, scheme+"://")
+	}
+	backendsMu.RUnlock()
+	if !ok {
+		sort.Strings(schemes)
+		return nil, "", fmt.Errorf("unknown image source scheme %q in %q, expected one of %s",
+			u.Scheme, source, strings.Join(schemes, ", "))
+	}
+
+	d, p, err := b(u)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to open image source %q: %s", source, err)
+	}
+	return d, p, nil
+}
+
+// fileBackend serves file:// sources. Both file:///abs/path and relative
+// file://./path forms are accepted.
+func fileBackend(u *url.URL) (Directory, string, error) {
+	p := u.Host + u.Path
+	if p == "" {
+		return nil, "", fmt.Errorf("missing directory")
+	}
+	return &Dir{}, p, nil
+}
+
+// archiveBackend serves zip:// and tar:// sources, such as
+// zip:///srv/chickens.zip or tar://./chickens.tar.gz.
+func archiveBackend(u *url.URL) (Directory, string, error) {
+	p := u.Host + u.Path
+	if p == "" {
+		return nil, "", fmt.Errorf("missing archive")
+	}
+	return &Archive{}, p, nil
+}
+
+// s3Backend serves s3://bucket/prefix/ sources. Connection settings come from
+// the environment, and can be overridden with the region, endpoint,
+// path_style and profile query parameters. The listing is refreshed in the
+// background every defaultS3TTL, or as often as a ttl parameter such as 1m
+// says.
+func s3Backend(u *url.URL) (Directory, string, error) {
+	if u.Host == "" {
+		return nil, "", fmt.Errorf("missing bucket")
+	}
+	o := S3OptionsFromEnv()
+	q := u.Query()
+	if v := q.Get("region"); v != "" {
+		o.Region = v
+	}
+	if v := q.Get("endpoint"); v != "" {
+		o.Endpoint = v
+	}
+	if v := q.Get("profile"); v != "" {
+		o.Profile = v
+	}
+	if v := q.Get("path_style"); v != "" {
+		pathStyle, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid path_style %q", v)
+		}
+		o.PathStyle = pathStyle
+	}
+	s, err := S3Config(o)
+	if err != nil {
+		return nil, "", err
+	}
+	s.TTL = defaultS3TTL
+	if v := q.Get("ttl"); v != "" {
+		s.TTL, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid ttl %q", v)
+		}
+	}
+	return &s, "s3://" + u.Host + u.Path, nil
+}
+
+// Defaults for the S3 and HTTP origin settings left unset.
+const (
+	// defaultS3TTL is how often bucket listings are refreshed.
+	defaultS3TTL = 5 * time.Minute
+	// defaultHTTPTTL is how often manifests are revalidated.
+	defaultHTTPTTL = 5 * time.Minute
+	// defaultHTTPCacheBytes bounds the copies of originals kept on disk.
+	defaultHTTPCacheBytes = 1 << 30
+)
+
+// httpBackend serves http:// and https:// manifest URLs, caching downloads in
+// HTTP_CACHE_DIR, up to HTTP_CACHE_MAX_BYTES, revalidating manifests every
+// HTTP_TTL and giving up on requests after HTTP_TIMEOUT.
+func httpBackend(u *url.URL) (Directory, string, error) {
+	if u.Host == "" {
+		return nil, "", fmt.Errorf("missing host")
+	}
+	o := &HTTPOrigin{CacheDir: os.Getenv("HTTP_CACHE_DIR"), TTL: defaultHTTPTTL, MaxBytes: defaultHTTPCacheBytes}
+	if v := os.Getenv("HTTP_CACHE_MAX_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid HTTP_CACHE_MAX_BYTES %q", v)
+		}
+		o.MaxBytes = n
+	}
+	if v := os.Getenv("HTTP_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid HTTP_TTL %q", v)
+		}
+		o.TTL = ttl
+	}
+	if v := os.Getenv("HTTP_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid HTTP_TIMEOUT %q", v)
+		}
+		o.Client = &http.Client{Timeout: timeout}
+	}
+	return o, u.String(), nil
+}
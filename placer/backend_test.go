@@ -0,0 +1,98 @@
+package placer
+
+import (
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenSource(t *testing.T) {
+	tt := []struct {
+		source string
+		path   string
+	}{
+		{source: "../static/images/test/", path: "../static/images/test/"},
+		{source: "file://../static/images/test/", path: "../static/images/test/"},
+		{source: "file:///srv/chickens", path: "/srv/chickens"},
+	}
+	for _, table := range tt {
+		d, p, err := OpenSource(table.source)
+		assert.Nil(t, err, table.source)
+		assert.IsType(t, &Dir{}, d, table.source)
+		assert.Equal(t, table.path, p, table.source)
+	}
+
+	_, _, err := OpenSource("ftp://chickens/")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), `unknown image source scheme "ftp"`)
+		assert.Contains(t, err.Error(), "file://, http://, https://, s3://, tar://, zip://")
+	}
+	_, _, err = OpenSource("s3:///chickens")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "missing bucket")
+	}
+}
+
+func TestOpenSourceS3(t *testing.T) {
+	srv, _ := newFakeS3(t, map[string]map[string]string{
+		"placechicken-test": {"chickens/original-1.jpg": "one"},
+	})
+	defer srv.Close()
+
+	d, p, err := OpenSource("s3://placechicken-test/chickens/?region=us-east-1&path_style=true&ttl=1m&endpoint=" + url.QueryEscape(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "s3://placechicken-test/chickens/", p)
+	s := d.(*S3)
+	assert.Equal(t, "us-east-1", *s.Session.Config.Region)
+	assert.Equal(t, "1m0s", s.TTL.String())
+
+	d, _, err = OpenSource("s3://placechicken-test/chickens/?region=us-east-1&path_style=true&endpoint=" + url.QueryEscape(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, defaultS3TTL, d.(*S3).TTL, "listings are refreshed by default")
+}
+
+func TestOpenSourceHTTP(t *testing.T) {
+	d, p, err := OpenSource("https://example.com/chickens.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "https://example.com/chickens.txt", p)
+	assert.Equal(t, defaultHTTPTTL, d.(*HTTPOrigin).TTL)
+	assert.Equal(t, int64(defaultHTTPCacheBytes), d.(*HTTPOrigin).MaxBytes)
+	assert.Equal(t, defaultHTTPTimeout, d.(*HTTPOrigin).client().Timeout)
+
+	os.Setenv("HTTP_TTL", "1m")
+	defer os.Unsetenv("HTTP_TTL")
+	d, _, err = OpenSource("https://example.com/chickens.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute, d.(*HTTPOrigin).TTL)
+
+	os.Setenv("HTTP_TIMEOUT", "5s")
+	defer os.Unsetenv("HTTP_TIMEOUT")
+	d, _, err = OpenSource("https://example.com/chickens.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, 5*time.Second, d.(*HTTPOrigin).client().Timeout)
+
+	os.Setenv("HTTP_TTL", "often")
+	_, _, err = OpenSource("https://example.com/chickens.txt")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), `invalid HTTP_TTL "often"`)
+	}
+}
+
+func TestRegisterBackend(t *testing.T) {
+	RegisterBackend("test", func(u *url.URL) (Directory, string, error) {
+		return &MockDir{}, u.Host, nil
+	})
+	d, p, err := OpenSource("test://chickens")
+	assert.Nil(t, err)
+	assert.IsType(t, &MockDir{}, d)
+	assert.Equal(t, "chickens", p)
+}
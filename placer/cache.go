@@ -0,0 +1,227 @@
+package placer
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// tmpPrefix marks files that are still being written to the cache directory.
+const tmpPrefix = ".tmp-"
+
+// lru is a size bounded least recently used index. It is not safe for
+// concurrent use; callers hold their own lock.
+type lru struct {
+	max     int64
+	size    int64
+	ll      *list.List
+	items   map[string]*list.Element
+	onEvict func(key string, value interface{})
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+	size  int64
+}
+
+// newLRU returns an lru that evicts entries once their combined size exceeds
+// max. A max of zero or less never evicts.
+func newLRU(max int64, onEvict func(string, interface{})) *lru {
+	return &lru{
+		max:     max,
+		ll:      list.New(),
+		items:   map[string]*list.Element{},
+		onEvict: onEvict,
+	}
+}
+
+func (c *lru) get(key string) (interface{}, bool) {
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*lruEntry).value, true
+}
+
+func (c *lru) add(key string, value interface{}, size int64) {
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*lruEntry)
+		c.size += size - e.size
+		e.value, e.size = value, size
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[key] = c.ll.PushFront(&lruEntry{key: key, value: value, size: size})
+		c.size += size
+	}
+	for c.max > 0 && c.size > c.max && c.ll.Len() > 0 {
+		c.evict(c.ll.Back())
+	}
+}
+
+func (c *lru) remove(key string) {
+	if el, ok := c.items[key]; ok {
+		c.drop(el)
+	}
+}
+
+func (c *lru) evict(el *list.Element) {
+	e := c.drop(el)
+	if c.onEvict != nil {
+		c.onEvict(e.key, e.value)
+	}
+}
+
+func (c *lru) drop(el *list.Element) *lruEntry {
+	e := c.ll.Remove(el).(*lruEntry)
+	delete(c.items, e.key)
+	c.size -= e.size
+	return e
+}
+
+// DiskCache keeps encoded renditions as files in a directory, removing the
+// least recently used ones once the directory grows past MaxBytes.
+type DiskCache struct {
+	Dir      string
+	MaxBytes int64
+	mu       sync.Mutex
+	lru      *lru
+}
+
+// NewDiskCache returns a cache rooted at dir, indexing any renditions already
+// there so a restart doesn't forget about them. A maxBytes of zero or less
+// disables eviction.
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	c := &DiskCache{Dir: dir, MaxBytes: maxBytes}
+	c.lru = newLRU(maxBytes, func(path string, _ interface{}) {
+		os.Remove(path)
+	})
+
+	// oldest first, so the most recently written files end up at the front
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+		if strings.HasPrefix(file.Name(), tmpPrefix) {
+			// left behind by a write that never finished
+			os.Remove(path)
+			continue
+		}
+		if file.Mode().IsRegular() {
+			c.lru.add(path, nil, file.Size())
+		}
+	}
+	return c, nil
+}
+
+// Get returns the contents of the rendition stored at path.
+func (c *DiskCache) Get(path string) ([]byte, bool) {
+	path = filepath.Clean(path)
+	c.mu.Lock()
+	_, ok := c.lru.get(path)
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	// read without the lock, so a slow disk doesn't hold up other requests
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			// removed behind our back, forget about it
+			c.lru.remove(path)
+		}
+		return nil, false
+	}
+	return data, true
+}
+
+// Put stores data at path. The file is written under a temporary name and
+// renamed into place, so readers never see a partial rendition.
+func (c *DiskCache) Put(path string, data []byte) error {
+	path = filepath.Clean(path)
+	if err := writeAtomic(path, bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.add(path, nil, int64(len(data)))
+	return nil
+}
+
+// Add indexes a file written into the cache directory by other means, such
+// as a download streamed to disk, evicting older files if the cache grows too
+// large.
+func (c *DiskCache) Add(path string) error {
+	path = filepath.Clean(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.add(path, nil, info.Size())
+	return nil
+}
+
+// Touch marks the file at path as recently used, reporting whether it is
+// cached.
+func (c *DiskCache) Touch(path string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.lru.get(filepath.Clean(path))
+	return ok
+}
+
+// Remove deletes the file at path from the cache.
+func (c *DiskCache) Remove(path string) {
+	path = filepath.Clean(path)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.remove(path)
+	os.Remove(path)
+}
+
+// Size returns the combined size in bytes of the cached renditions.
+func (c *DiskCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.size
+}
+
+// writeAtomic writes r to path through a temporary file, so readers never see
+// a partial file.
+func writeAtomic(path string, r io.Reader) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), tmpPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, r)
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
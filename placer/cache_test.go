@@ -0,0 +1,87 @@
+package placer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskCachePutGet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "placechicken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewDiskCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := dir + "/image-300x200.jpg"
+	_, ok := c.Get(path)
+	assert.False(t, ok)
+
+	assert.Nil(t, c.Put(path, []byte("chicken")))
+	data, ok := c.Get(path)
+	assert.True(t, ok)
+	assert.Equal(t, "chicken", string(data))
+
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files), "temporary files should be renamed into place")
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "placechicken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewDiskCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := filepath.Join(dir, "a.jpg")
+	b := filepath.Join(dir, "b.jpg")
+	d := filepath.Join(dir, "c.jpg")
+	assert.Nil(t, c.Put(a, []byte("aaaa")))
+	assert.Nil(t, c.Put(b, []byte("bbbb")))
+	// touch a so that b is the least recently used
+	_, ok := c.Get(a)
+	assert.True(t, ok)
+	assert.Nil(t, c.Put(d, []byte("cccc")))
+
+	_, err = os.Stat(b)
+	assert.True(t, os.IsNotExist(err), "least recently used file should be removed")
+	_, ok = c.Get(a)
+	assert.True(t, ok)
+	_, ok = c.Get(d)
+	assert.True(t, ok)
+	assert.Equal(t, int64(8), c.Size())
+}
+
+func TestDiskCacheIndexesExistingFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "placechicken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "image-300x200.jpg")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("chicken"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, tmpPrefix+"123"), []byte("partial"), 0644))
+
+	c, err := NewDiskCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, ok := c.Get(path)
+	assert.True(t, ok)
+	assert.Equal(t, "chicken", string(data))
+	_, err = os.Stat(filepath.Join(dir, tmpPrefix+"123"))
+	assert.True(t, os.IsNotExist(err), "unfinished writes should be cleaned up")
+}
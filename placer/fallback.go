@@ -0,0 +1,139 @@
+package placer
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+)
+
+// Reasons a Rendition may be a generated fallback rather than an original.
+const (
+	// FallbackEmpty is used when the library has no originals to pick.
+	FallbackEmpty = "empty"
+	// FallbackUnavailable is used when the backend couldn't be read.
+	FallbackUnavailable = "unavailable"
+)
+
+// Dimensions of a fallback when the request gives none.
+const (
+	defaultFallbackWidth  = 640
+	defaultFallbackHeight = 480
+)
+
+// Fallback is the image generated when no original is available: a diagonal
+// gradient from From to To, labelled with its dimensions. When both colors
+// are the same it is a solid fill.
+type Fallback struct {
+	From color.Color
+	To   color.Color
+}
+
+// DefaultFallback is a light gray gradient.
+var DefaultFallback = &Fallback{
+	From: color.NRGBA{R: 0xdd, G: 0xdd, B: 0xdd, A: 0xff},
+	To:   color.NRGBA{R: 0x99, G: 0x99, B: 0x99, A: 0xff},
+}
+
+// ParseFallback reads a fallback setting: one color for a solid fill, two
+// comma separated ones for a gradient, or "off" to serve errors instead. An
+// empty setting is the DefaultFallback.
+func ParseFallback(s string) (*Fallback, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "":
+		return DefaultFallback, nil
+	case "off", "false", "none":
+		return nil, nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) > 2 {
+		return nil, fmt.Errorf("invalid fallback %q, expected one or two colors or off", s)
+	}
+	from, err := ParseColor(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	to := from
+	if len(parts) == 2 {
+		if to, err = ParseColor(parts[1]); err != nil {
+			return nil, err
+		}
+	}
+	return &Fallback{From: from, To: to}, nil
+}
+
+// image draws the fill at w by h.
+func (f *Fallback) image(w int, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	from := color.NRGBAModel.Convert(f.From).(color.NRGBA)
+	to := color.NRGBAModel.Convert(f.To).(color.NRGBA)
+	mix := func(a uint8, b uint8, t float64) uint8 {
+		return uint8(float64(a) + (float64(b)-float64(a))*t + 0.5)
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			t := (float64(x)/float64(w) + float64(y)/float64(h)) / 2
+			i := img.PixOffset(x, y)
+			img.Pix[i+0] = mix(from.R, to.R, t)
+			img.Pix[i+1] = mix(from.G, to.G, t)
+			img.Pix[i+2] = mix(from.B, to.B, t)
+			img.Pix[i+3] = mix(from.A, to.A, t)
+		}
+	}
+	return img
+}
+
+// fallbackReason reports why a rendition falls back after err, or "" when
+// it shouldn't: asking for an ID or tags that don't exist is the caller's
+// mistake, not a missing source.
+func fallbackReason(o Options, err error) string {
+	if !errors.Is(err, ErrNotFound) {
+		return FallbackUnavailable
+	}
+	if o.ID != "" || len(o.Tags) > 0 {
+		return ""
+	}
+	return FallbackEmpty
+}
+
+// fallback generates a rendition for the options from the place's
+// Fallback, going through the same steps as an original would.
+func (p *Place) fallback(o Options, reason string) (Rendition, error) {
+	w, h := o.size()
+	switch {
+	case w <= 0 && h <= 0:
+		w, h = defaultFallbackWidth, defaultFallbackHeight
+	case w <= 0:
+		w = h
+	case h <= 0:
+		h = w
+	}
+	if w > MaxSize || h > MaxSize {
+		return Rendition{}, fmt.Errorf("fallback of %dx%d is over the maximum size of %d", w, h, MaxSize)
+	}
+	if o.Label == nil {
+		o.Label = &Label{Color: contrasting(p.Fallback.From)}
+	}
+	// fallbacks aren't written to disk, as the originals may be back any
+	// moment, but are kept in memory so an outage doesn't mean generating
+	// one for every request
+	variant := o.variant(nil)
+	if p.Watermark != nil {
+		variant = append(variant, p.Watermark.Key())
+	}
+	key := fmt.Sprintf("\x00fallback-%s-%s-%dx%d-%s", colorHex(p.Fallback.From), colorHex(p.Fallback.To), w, h, strings.Join(variant, "-"))
+	if p.Memory != nil {
+		if data, ok := p.Memory.Rendition(key); ok {
+			return Rendition{Data: data, Fallback: reason}, nil
+		}
+	}
+	data, err := p.encode(p.Fallback.image(w, h), o, nil)
+	if err != nil {
+		return Rendition{}, err
+	}
+	if p.Memory != nil {
+		p.Memory.AddRendition(key, data)
+	}
+	return Rendition{Data: data, Fallback: reason}, nil
+}
@@ -0,0 +1,123 @@
+package placer
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/colornames"
+)
+
+func TestParseFallback(t *testing.T) {
+	tt := []struct {
+		setting  string
+		expected *Fallback
+		err      string
+	}{
+		{setting: "", expected: DefaultFallback},
+		{setting: "off", expected: nil},
+		{setting: "None", expected: nil},
+		{setting: "papayawhip", expected: &Fallback{From: colornames.Papayawhip, To: colornames.Papayawhip}},
+		{setting: "fff,navy", expected: &Fallback{From: color.NRGBA{R: 255, G: 255, B: 255, A: 255}, To: colornames.Navy}},
+		{setting: "fff,000,f00", err: `invalid fallback "fff,000,f00", expected one or two colors or off`},
+		{setting: "nope", err: `invalid color "nope", expected a hex value like ff8800 or a color name`},
+	}
+	for _, table := range tt {
+		f, err := ParseFallback(table.setting)
+		if table.err != "" {
+			if assert.NotNil(t, err, table.setting) {
+				assert.Equal(t, table.err, err.Error())
+			}
+			continue
+		}
+		assert.Nil(t, err, table.setting)
+		assert.Equal(t, table.expected, f, table.setting)
+	}
+}
+
+func TestFallbackImage(t *testing.T) {
+	white := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	black := color.NRGBA{A: 255}
+	img := (&Fallback{From: white, To: black}).image(100, 50)
+	assert.Equal(t, image.Rect(0, 0, 100, 50), img.Bounds())
+	assert.Equal(t, white, img.NRGBAAt(0, 0))
+	mid := img.NRGBAAt(50, 25)
+	assert.True(t, mid.R > 120 && mid.R < 135, "the middle should be halfway, got %v", mid)
+	assert.True(t, img.NRGBAAt(99, 49).R < 5)
+
+	solid := (&Fallback{From: white, To: white}).image(10, 10)
+	assert.Equal(t, white, solid.NRGBAAt(9, 9))
+}
+
+func TestRenderFallback(t *testing.T) {
+	td := MockDir{}
+	place := Place{
+		Dir:              &td,
+		OriginalFilePath: "../static/images/test/",
+	}
+	td.On("Library", "../static/images/test/").Return(MockLibrary("../static/images/test/"), nil)
+
+	_, err := place.Render(Options{Width: 300, Height: 200})
+	assert.Equal(t, ErrNotFound, err, "without a fallback the error is returned")
+
+	place.Fallback = DefaultFallback
+	tt := []struct {
+		name     string
+		options  Options
+		expected image.Point
+	}{
+		{name: "both dimensions", options: Options{Width: 300, Height: 200}, expected: image.Pt(300, 200)},
+		{name: "a single dimension is squared", options: Options{Width: 120}, expected: image.Pt(120, 120)},
+		{name: "no dimensions", options: Options{}, expected: image.Pt(defaultFallbackWidth, defaultFallbackHeight)},
+	}
+	for _, table := range tt {
+		r, err := place.Render(table.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, FallbackEmpty, r.Fallback, table.name)
+		img, err := imaging.Decode(bytes.NewReader(r.Data))
+		assert.Nil(t, err, table.name)
+		assert.Equal(t, table.expected, img.Bounds().Size(), table.name)
+	}
+
+	_, err = place.Render(Options{Width: MaxSize + 1})
+	assert.NotNil(t, err, "fallbacks are bounded like any rendition")
+	_, err = place.Render(Options{Width: 300, Height: 200, ID: "bogus"})
+	assert.Equal(t, ErrNotFound, err, "a missing id isn't a missing source")
+	_, err = place.Render(Options{Width: 300, Height: 200, Tags: []string{"ducks"}})
+	assert.True(t, errors.Is(err, ErrNotFound), "nor are missing tags")
+
+	down := MockDir{}
+	place.Dir = &down
+	down.On("Library", "../static/images/test/").Return((*Library)(nil), errors.New("backend down"))
+	r, err := place.Render(Options{Width: 300, Height: 200, ID: "bogus"})
+	assert.Nil(t, err)
+	assert.Equal(t, FallbackUnavailable, r.Fallback)
+}
+
+func TestRenderFallbackMemoryCache(t *testing.T) {
+	td := MockDir{}
+	mem := NewMemCache(64<<20, 8<<20)
+	place := Place{
+		Dir:              &td,
+		OriginalFilePath: "../static/images/test/",
+		Memory:           mem,
+		Fallback:         DefaultFallback,
+	}
+	td.On("Library", "../static/images/test/").Return((*Library)(nil), errors.New("backend down"))
+
+	first, err := place.Render(Options{Width: 300, Height: 200})
+	assert.Nil(t, err)
+	second, err := place.Render(Options{Width: 300, Height: 200})
+	assert.Nil(t, err)
+	assert.Equal(t, first.Data, second.Data)
+	assert.Equal(t, FallbackUnavailable, second.Fallback)
+	_, err = place.Render(Options{Width: 200, Height: 300})
+	assert.Nil(t, err)
+	assert.Equal(t, CacheStats{RenditionHits: 1, RenditionMisses: 2}, mem.Stats())
+}
@@ -0,0 +1,181 @@
+package placer
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Filters adjust a rendition's colors after it has been resized. The zero
+// value leaves it untouched.
+type Filters struct {
+	Grayscale bool
+	Sepia     bool
+	// Saturation, Brightness and Contrast are percentages between -100
+	// and 100.
+	Saturation float64
+	Brightness float64
+	Contrast   float64
+	// Gamma darkens the rendition below 1 and lightens it above, between
+	// 0.1 and 10. Zero leaves it alone.
+	Gamma float64
+	// Blur is the sigma of a gaussian blur, up to 20.
+	Blur float64
+}
+
+// filterRange is the accepted range of a numeric filter parameter.
+type filterRange struct {
+	min, max float64
+}
+
+var filterRanges = map[string]filterRange{
+	"saturation": {-100, 100},
+	"brightness": {-100, 100},
+	"contrast":   {-100, 100},
+	"gamma":      {0.1, 10},
+	"blur":       {0, 20},
+}
+
+// ParseFilters reads filters from query parameters such as ?grayscale,
+// ?blur=3 and ?brightness=-20, checking their ranges.
+func ParseFilters(q url.Values) (Filters, error) {
+	var f Filters
+	var err error
+	if f.Grayscale, err = parseFlag(q, "grayscale"); err != nil {
+		return f, err
+	}
+	if f.Sepia, err = parseFlag(q, "sepia"); err != nil {
+		return f, err
+	}
+	for _, level := range []struct {
+		name  string
+		value *float64
+	}{
+		{"saturation", &f.Saturation},
+		{"brightness", &f.Brightness},
+		{"contrast", &f.Contrast},
+		{"gamma", &f.Gamma},
+		{"blur", &f.Blur},
+	} {
+		if *level.value, err = parseLevel(q, level.name); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+// parseFlag reads an on/off parameter, which is on when given without a
+// value, as in ?grayscale.
+func parseFlag(q url.Values, name string) (bool, error) {
+	if _, ok := q[name]; !ok {
+		return false, nil
+	}
+	v := q.Get(name)
+	if v == "" {
+		return true, nil
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q, expected true or false", name, v)
+	}
+	return on, nil
+}
+
+func parseLevel(q url.Values, name string) (float64, error) {
+	v := q.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	r := filterRanges[name]
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(n) || n < r.min || n > r.max {
+		return 0, fmt.Errorf("invalid %s %q, expected a number between %g and %g", name, v, r.min, r.max)
+	}
+	return n, nil
+}
+
+// Apply runs the filters over img, always in the same order.
+func (f Filters) Apply(img image.Image) image.Image {
+	if f.Grayscale {
+		img = imaging.Grayscale(img)
+	}
+	if f.Sepia {
+		img = imaging.AdjustFunc(img, sepia)
+	}
+	if f.Saturation != 0 {
+		img = imaging.AdjustSaturation(img, f.Saturation)
+	}
+	if f.Brightness != 0 {
+		img = imaging.AdjustBrightness(img, f.Brightness)
+	}
+	if f.Contrast != 0 {
+		img = imaging.AdjustContrast(img, f.Contrast)
+	}
+	if f.Gamma != 0 && f.Gamma != 1 {
+		img = imaging.AdjustGamma(img, f.Gamma)
+	}
+	if f.Blur > 0 {
+		img = imaging.Blur(img, f.Blur)
+	}
+	return img
+}
+
+// key returns the cache name parts for the filters, in the order they are
+// applied, so equivalent requests share a rendition.
+func (f Filters) key() []string {
+	k := []string{}
+	if f.Grayscale {
+		k = append(k, "gray")
+	}
+	if f.Sepia {
+		k = append(k, "sepia")
+	}
+	for _, level := range []struct {
+		name  string
+		value float64
+	}{
+		{"sat", f.Saturation},
+		{"bright", f.Brightness},
+		{"contrast", f.Contrast},
+		{"gamma", f.Gamma},
+		{"blur", f.Blur},
+	} {
+		if level.value == 0 || (level.name == "gamma" && level.value == 1) {
+			continue
+		}
+		k = append(k, level.name+strconv.FormatFloat(level.value, 'f', -1, 64))
+	}
+	if len(k) == 0 {
+		return nil
+	}
+	return k
+}
+
+// Key joins the filters' cache name parts, making Filters a Transform.
+func (f Filters) Key() string {
+	return strings.Join(f.key(), "-")
+}
+
+// sepia tones a pixel with the usual sepia matrix.
+func sepia(c color.NRGBA) color.NRGBA {
+	r, g, b := float64(c.R), float64(c.G), float64(c.B)
+	return color.NRGBA{
+		R: clampUint8(0.393*r + 0.769*g + 0.189*b),
+		G: clampUint8(0.349*r + 0.686*g + 0.168*b),
+		B: clampUint8(0.272*r + 0.534*g + 0.131*b),
+		A: c.A,
+	}
+}
+
+func clampUint8(v float64) uint8 {
+	if v > 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
@@ -0,0 +1,71 @@
+package placer
+
+import (
+	"image"
+	"image/color"
+	"net/url"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFilters(t *testing.T) {
+	tt := []struct {
+		query    string
+		expected Filters
+		err      string
+	}{
+		{query: "", expected: Filters{}},
+		{query: "grayscale", expected: Filters{Grayscale: true}},
+		{query: "grayscale=false&sepia=1", expected: Filters{Sepia: true}},
+		{query: "blur=3&brightness=-20&gamma=1.5", expected: Filters{Blur: 3, Brightness: -20, Gamma: 1.5}},
+		{query: "contrast=10&saturation=-100", expected: Filters{Contrast: 10, Saturation: -100}},
+		{query: "grayscale=maybe", err: `invalid grayscale "maybe", expected true or false`},
+		{query: "blur=21", err: `invalid blur "21", expected a number between 0 and 20`},
+		{query: "brightness=lots", err: `invalid brightness "lots", expected a number between -100 and 100`},
+		{query: "gamma=0", err: `invalid gamma "0", expected a number between 0.1 and 10`},
+	}
+	for _, table := range tt {
+		q, err := url.ParseQuery(table.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := ParseFilters(q)
+		if table.err != "" {
+			if assert.NotNil(t, err, table.query) {
+				assert.Equal(t, table.err, err.Error())
+			}
+			continue
+		}
+		assert.Nil(t, err, table.query)
+		assert.Equal(t, table.expected, f, table.query)
+	}
+}
+
+func TestFiltersKey(t *testing.T) {
+	assert.Nil(t, Filters{}.key())
+	assert.Nil(t, Filters{Gamma: 1}.key(), "a gamma of 1 changes nothing")
+	assert.Equal(t, []string{"gray", "bright-20", "blur3"}, Filters{Blur: 3, Brightness: -20, Grayscale: true}.key())
+	assert.Equal(t, []string{"fill", "center", "sepia", "gamma0.5"}, Options{
+		Width:   300,
+		Height:  200,
+		Filters: Filters{Sepia: true, Gamma: 0.5},
+	}.variant(nil))
+	assert.Equal(t, []string{"gray"}, Options{Width: 300, Filters: Filters{Grayscale: true}}.variant(nil))
+}
+
+func TestFiltersApply(t *testing.T) {
+	src := imaging.New(4, 4, color.NRGBA{R: 200, G: 40, B: 40, A: 255})
+	gray := color.NRGBAModel.Convert(Filters{Grayscale: true}.Apply(src).At(1, 1)).(color.NRGBA)
+	assert.True(t, gray.R == gray.G && gray.G == gray.B, "grayscale should drop the color")
+
+	toned := color.NRGBAModel.Convert(Filters{Sepia: true}.Apply(src).At(1, 1)).(color.NRGBA)
+	assert.True(t, toned.R > toned.G && toned.G > toned.B, "sepia should tint brown")
+
+	dark := color.NRGBAModel.Convert(Filters{Brightness: -50}.Apply(src).At(1, 1)).(color.NRGBA)
+	assert.True(t, dark.R < 200)
+
+	var untouched image.Image = src
+	assert.Equal(t, untouched, Filters{}.Apply(src))
+}
@@ -0,0 +1,52 @@
+package placer
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// FS serves originals from an fs.FS, such as the starter library embedded in
+// the binary. Paths handed to it are slash separated directories within the
+// FS, with "." for its root.
+type FS struct {
+	FS fs.FS
+	libraries
+}
+
+// Library returns the index of images in a directory of the FS, building it
+// on first use.
+func (f *FS) Library(p string) (*Library, error) {
+	return f.libraries.get(p, func(p string) *Library {
+		l := NewLibrary(p, f.list)
+		l.open = f.Open
+		l.head = f.Open
+		return l
+	})
+}
+
+// Open opens an image in the FS for reading.
+func (f *FS) Open(p string, i Image) (io.ReadCloser, error) {
+	return f.FS.Open(path.Join(p, i.Name))
+}
+
+func (f *FS) list(p string) ([]Image, error) {
+	entries, err := fs.ReadDir(f.FS, p)
+	i := []Image{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.Contains(entry.Name(), "original") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return i, err
+		}
+		i = append(i, Image{
+			Name:    entry.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+	return i, err
+}
@@ -0,0 +1,33 @@
+package placer
+
+import (
+	"io/ioutil"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFS(t *testing.T) {
+	f := FS{FS: fstest.MapFS{
+		"chickens/original-1.jpg":     {Data: []byte("one")},
+		"chickens/README":             {Data: []byte("not a chicken")},
+		"chickens/sub/original-2.jpg": {Data: []byte("two")},
+	}}
+	i, err := randImg(&f, "chickens")
+	assert.Nil(t, err)
+	assert.Equal(t, "original-1.jpg", i.Name)
+	assert.Equal(t, int64(3), i.Size)
+
+	rc, err := f.Open("chickens", i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	assert.Nil(t, err)
+	assert.Equal(t, "one", string(data))
+
+	_, err = randImg(&f, "ducks")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,400 @@
+package placer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPOrigin serves originals hosted on another web server. Paths handed to
+// it are the URL of a manifest listing the images, either as a JSON array of
+// URLs or as plain text with one URL per line. Manifests and originals are
+// kept in CacheDir and revalidated against the origin with ETag and
+// Last-Modified, so unchanged files are only downloaded once. Copies of
+// images dropped from a manifest are removed when it is reloaded.
+type HTTPOrigin struct {
+	// Client defaults to one that gives up on requests after
+	// defaultHTTPTimeout.
+	Client *http.Client
+	// CacheDir defaults to a placechicken-http directory under os.TempDir.
+	CacheDir string
+	// MaxBytes bounds the size of CacheDir, removing the least recently
+	// used copies past it. Zero doesn't bound it.
+	MaxBytes int64
+	// TTL is how long a manifest is served before it is revalidated in the
+	// background. Zero keeps a manifest until it is reloaded.
+	TTL time.Duration
+	libraries
+
+	cacheOnce sync.Once
+	cache     *DiskCache
+	cacheErr  error
+
+	mu sync.Mutex
+	// locks serializes fetches of the same URL, and only holds the URLs
+	// being fetched.
+	locks map[string]*fetchLock
+	// listed is the cache keys of each manifest's images, for pruning.
+	listed map[string]map[string]bool
+}
+
+// fetchLock is a mutex shared by the fetches of one URL.
+type fetchLock struct {
+	sync.Mutex
+	refs int
+}
+
+// cacheMeta holds the validators for a cached response.
+type cacheMeta struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// readCacheMeta reads the validators of the copy cached at p, if any.
+func readCacheMeta(p string) cacheMeta {
+	meta := cacheMeta{}
+	if data, err := ioutil.ReadFile(p + ".meta"); err == nil {
+		json.Unmarshal(data, &meta)
+	}
+	return meta
+}
+
+// version is the validator that identifies a revision, the ETag if there is
+// one.
+func (m cacheMeta) version() string {
+	if m.ETag != "" {
+		return m.ETag
+	}
+	return m.LastModified
+}
+
+// Library returns the index of images in a manifest, building it on first use.
+func (o *HTTPOrigin) Library(m string) (*Library, error) {
+	return o.libraries.get(m, func(m string) *Library {
+		l := NewLibrary(m, o.list)
+		l.ttl = o.TTL
+		l.open = o.Open
+		l.head = o.head
+		return l
+	})
+}
+
+// Open returns the local copy of an image, fetching or revalidating it first.
+// Relative names, such as the MetadataFile, are resolved against the
+// manifest URL.
+func (o *HTTPOrigin) Open(m string, i Image) (io.ReadCloser, error) {
+	base, err := url.Parse(m)
+	if err != nil {
+		return nil, err
+	}
+	u, err := base.Parse(i.Name)
+	if err != nil {
+		return nil, err
+	}
+	return o.fetch(u.String())
+}
+
+// head reads the start of an image for its dimensions, from the cached copy
+// if there is one and otherwise with a ranged request that isn't cached, so
+// indexing doesn't download the whole library.
+func (o *HTTPOrigin) head(m string, i Image) (io.ReadCloser, error) {
+	if f, err := os.Open(filepath.Join(o.cacheDir(), cacheKey(i.Name))); err == nil {
+		return f, nil
+	}
+	req, err := http.NewRequest("GET", i.Name, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", headerBytes-1))
+	resp, err := o.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unable to fetch %s: %s", i.Name, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (o *HTTPOrigin) list(m string) ([]Image, error) {
+	f, err := o.fetch(m)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	base, err := url.Parse(m)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []string
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		if err := json.Unmarshal(trimmed, &refs); err != nil {
+			return nil, fmt.Errorf("invalid manifest %s: %s", m, err)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				refs = append(refs, line)
+			}
+		}
+	}
+
+	i := []Image{}
+	for _, ref := range refs {
+		u, err := base.Parse(ref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid image url %q in manifest %s: %s", ref, m, err)
+		}
+		i = append(i, Image{Name: u.String()})
+	}
+	o.prune(m, i)
+	o.validate(i)
+	return i, nil
+}
+
+// validate sets each image's ETag from the origin's validators, with a HEAD
+// request, so an image changed at the origin gets a new version and isn't
+// served from renditions of the old one. An image the origin can't be asked
+// about keeps the validators of the copy we have, if any.
+func (o *HTTPOrigin) validate(images []Image) {
+	sem := make(chan struct{}, measureWorkers)
+	var wg sync.WaitGroup
+	for n := range images {
+		i := &images[n]
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			meta, err := o.validators(i.Name)
+			if err != nil {
+				meta = readCacheMeta(filepath.Join(o.cacheDir(), cacheKey(i.Name)))
+			}
+			i.ETag = meta.version()
+		}()
+	}
+	wg.Wait()
+}
+
+// validators asks the origin for the validators of u.
+func (o *HTTPOrigin) validators(u string) (cacheMeta, error) {
+	req, err := http.NewRequest("HEAD", u, nil)
+	if err != nil {
+		return cacheMeta{}, err
+	}
+	resp, err := o.client().Do(req)
+	if err != nil {
+		return cacheMeta{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return cacheMeta{}, fmt.Errorf("unable to fetch %s: %s", u, resp.Status)
+	}
+	return cacheMeta{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// prune removes the copies of images that were in the manifest the last
+// time it was listed but no longer are, unless another manifest lists them.
+func (o *HTTPOrigin) prune(m string, images []Image) {
+	keep := map[string]bool{}
+	for _, i := range images {
+		keep[cacheKey(i.Name)] = true
+	}
+	o.mu.Lock()
+	if o.listed == nil {
+		o.listed = map[string]map[string]bool{}
+	}
+	old := o.listed[m]
+	o.listed[m] = keep
+	dropped := []string{}
+	for key := range old {
+		if keep[key] {
+			continue
+		}
+		shared := false
+		for other, keys := range o.listed {
+			if other != m && keys[key] {
+				shared = true
+				break
+			}
+		}
+		if !shared {
+			dropped = append(dropped, key)
+		}
+	}
+	o.mu.Unlock()
+
+	cache, err := o.diskCache()
+	if err != nil {
+		return
+	}
+	for _, key := range dropped {
+		unlock := o.lock(key)
+		p := filepath.Join(cache.Dir, key)
+		cache.Remove(p)
+		cache.Remove(p + ".meta")
+		unlock()
+	}
+}
+
+// cacheKey names the cached copy of u.
+func cacheKey(u string) string {
+	sum := sha1.Sum([]byte(u))
+	return hex.EncodeToString(sum[:])
+}
+
+// lock takes the lock for fetching key, returning a function that releases
+// it. Locks are dropped once nothing waits on them.
+func (o *HTTPOrigin) lock(key string) func() {
+	o.mu.Lock()
+	if o.locks == nil {
+		o.locks = map[string]*fetchLock{}
+	}
+	l, ok := o.locks[key]
+	if !ok {
+		l = &fetchLock{}
+		o.locks[key] = l
+	}
+	l.refs++
+	o.mu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		o.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(o.locks, key)
+		}
+		o.mu.Unlock()
+	}
+}
+
+// diskCache indexes the cache directory on first use.
+func (o *HTTPOrigin) diskCache() (*DiskCache, error) {
+	o.cacheOnce.Do(func() {
+		o.cache, o.cacheErr = NewDiskCache(o.cacheDir(), o.MaxBytes)
+	})
+	return o.cache, o.cacheErr
+}
+
+// fetch makes sure an up to date copy of u is in the cache directory and
+// opens it. If the origin can't be reached a stale copy is used.
+func (o *HTTPOrigin) fetch(u string) (*os.File, error) {
+	cache, err := o.diskCache()
+	if err != nil {
+		return nil, err
+	}
+	key := cacheKey(u)
+	unlock := o.lock(key)
+	defer unlock()
+
+	p := filepath.Join(cache.Dir, key)
+	meta := cacheMeta{}
+	_, statErr := os.Stat(p)
+	cached := statErr == nil
+	if cached {
+		meta = readCacheMeta(p)
+	}
+	// opened while the lock is held, so the copy can't be replaced or
+	// pruned before it is read
+	cachedCopy := func() (*os.File, error) {
+		cache.Touch(p)
+		cache.Touch(p + ".meta")
+		return os.Open(p)
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cached && meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if cached && meta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
+	}
+	resp, err := o.client().Do(req)
+	if err != nil {
+		if cached {
+			return cachedCopy()
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached:
+		return cachedCopy()
+	case resp.StatusCode != http.StatusOK:
+		if cached && resp.StatusCode >= 500 {
+			return cachedCopy()
+		}
+		return nil, fmt.Errorf("unable to fetch %s: %s", u, resp.Status)
+	}
+
+	if err := writeAtomic(p, resp.Body); err != nil {
+		return nil, err
+	}
+	meta = cacheMeta{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeAtomic(p+".meta", bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	cache.Add(p)
+	cache.Add(p + ".meta")
+	return f, nil
+}
+
+// defaultHTTPTimeout bounds each request to the origin when no Client is
+// set, so a hung origin fails the request and a fallback can be served.
+const defaultHTTPTimeout = 30 * time.Second
+
+var defaultHTTPClient = &http.Client{Timeout: defaultHTTPTimeout}
+
+func (o *HTTPOrigin) client() *http.Client {
+	if o.Client != nil {
+		return o.Client
+	}
+	return defaultHTTPClient
+}
+
+func (o *HTTPOrigin) cacheDir() string {
+	if o.CacheDir != "" {
+		return o.CacheDir
+	}
+	return filepath.Join(os.TempDir(), "placechicken-http")
+}
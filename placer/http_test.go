@@ -0,0 +1,230 @@
+package placer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// origin is a static file server that counts full and conditional responses.
+type origin struct {
+	mu       sync.Mutex
+	files    map[string]string
+	full     int
+	notMod   int
+	heads    int
+	modified time.Time
+	// rng is the Range header of the last request.
+	rng string
+}
+
+func (o *origin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.rng = r.Header.Get("Range")
+	body, ok := o.files[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	etag := `"` + body + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", o.modified.Format(http.TimeFormat))
+	if r.Method == "HEAD" {
+		o.heads++
+		return
+	}
+	if r.Header.Get("If-None-Match") == etag {
+		o.notMod++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	o.full++
+	w.Write([]byte(body))
+}
+
+func TestHTTPOrigin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "placechicken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := &origin{
+		modified: time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC),
+		files: map[string]string{
+			"/manifest.json":         `["images/original-1.jpg", "/images/original-2.jpg"]`,
+			"/manifest.txt":          "# chickens\nimages/original-1.jpg\n\nhttp://elsewhere/original-3.jpg\n",
+			"/images/original-1.jpg": "one",
+			"/images/original-2.jpg": "two",
+		},
+	}
+	srv := httptest.NewServer(o)
+	defer srv.Close()
+	h := &HTTPOrigin{CacheDir: dir}
+
+	iList, err := h.list(srv.URL + "/manifest.json")
+	assert.Nil(t, err)
+	assert.Equal(t, []Image{
+		{Name: srv.URL + "/images/original-1.jpg", ETag: `"one"`},
+		{Name: srv.URL + "/images/original-2.jpg", ETag: `"two"`},
+	}, iList, "images are versioned by their ETags")
+
+	iList, err = h.list(srv.URL + "/manifest.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, []Image{
+		{Name: srv.URL + "/images/original-1.jpg", ETag: `"one"`},
+		{Name: "http://elsewhere/original-3.jpg"},
+	}, iList)
+
+	for i := 0; i < 3; i++ {
+		rc, err := h.Open(srv.URL+"/manifest.json", Image{Name: srv.URL + "/images/original-1.jpg"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, "one", string(data))
+	}
+	assert.Equal(t, 3, o.full, "each file should only be downloaded once")
+	assert.Equal(t, 2, o.notMod, "cached copies should be revalidated")
+
+	// a changed original is downloaded again
+	o.mu.Lock()
+	o.files["/images/original-1.jpg"] = "uno"
+	o.mu.Unlock()
+	rc, err := h.Open(srv.URL+"/manifest.json", Image{Name: srv.URL + "/images/original-1.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	assert.Equal(t, "uno", string(data))
+	iList, err = h.list(srv.URL + "/manifest.json")
+	assert.Nil(t, err)
+	assert.Equal(t, `"uno"`, iList[0].ETag, "a changed image gets a new version")
+
+	// measuring reads cached copies, and only the start of the others
+	rc, err = h.head(srv.URL+"/manifest.json", Image{Name: srv.URL + "/images/original-2.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadAll(rc)
+	rc.Close()
+	assert.Equal(t, "two", string(data))
+	assert.Equal(t, "bytes=0-65535", o.rng)
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, 6, len(files), "a header read isn't cached")
+	o.rng = ""
+	rc, err = h.head(srv.URL+"/manifest.json", Image{Name: srv.URL + "/images/original-1.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadAll(rc)
+	rc.Close()
+	assert.Equal(t, "uno", string(data))
+	assert.Equal(t, "", o.rng, "a cached copy needn't be fetched")
+
+	// the cached copy keeps being served while the origin is down
+	srv.Close()
+	rc, err = h.Open(srv.URL+"/manifest.json", Image{Name: srv.URL + "/images/original-1.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadAll(rc)
+	rc.Close()
+	assert.Equal(t, "uno", string(data))
+
+	_, err = h.Open(srv.URL+"/manifest.json", Image{Name: srv.URL + "/images/missing.jpg"})
+	assert.NotNil(t, err)
+}
+
+func TestHTTPOriginCacheBounds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "placechicken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := &origin{files: map[string]string{
+		"/manifest.txt":   "original-1.jpg\noriginal-2.jpg\n",
+		"/original-1.jpg": "one",
+		"/original-2.jpg": "two",
+		"/original-3.jpg": "three",
+	}}
+	srv := httptest.NewServer(o)
+	defer srv.Close()
+	h := &HTTPOrigin{CacheDir: dir}
+	cached := func(u string) bool {
+		_, err := os.Stat(filepath.Join(dir, cacheKey(srv.URL+u)))
+		return err == nil
+	}
+	open := func(u string) {
+		rc, err := h.Open(srv.URL+"/manifest.txt", Image{Name: srv.URL + u})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc.Close()
+	}
+
+	_, err = h.list(srv.URL + "/manifest.txt")
+	assert.Nil(t, err)
+	open("/original-1.jpg")
+	open("/original-2.jpg")
+	assert.True(t, cached("/original-2.jpg"))
+
+	// original-2 is dropped from the manifest
+	o.mu.Lock()
+	o.files["/manifest.txt"] = "original-1.jpg\n"
+	o.mu.Unlock()
+	_, err = h.list(srv.URL + "/manifest.txt")
+	assert.Nil(t, err)
+	assert.False(t, cached("/original-2.jpg"), "copies of dropped images should be removed")
+	assert.True(t, cached("/original-1.jpg"))
+	assert.Empty(t, h.locks, "locks are only held while fetching")
+
+	// a bounded cache keeps the most recently used copies
+	bounded := &HTTPOrigin{CacheDir: dir, MaxBytes: 100}
+	h = bounded
+	open("/original-3.jpg")
+	assert.True(t, cached("/original-3.jpg"))
+	assert.False(t, cached("/original-1.jpg"), "least recently used copies should be removed")
+	c, err := bounded.diskCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, c.Size() <= 100, "cache holds %d bytes", c.Size())
+}
+
+func TestHTTPOriginLibrary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "placechicken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := httptest.NewServer(&origin{files: map[string]string{
+		"/manifest.txt": "original-1.jpg\n",
+	}})
+	defer srv.Close()
+
+	d, p, err := OpenSource(srv.URL + "/manifest.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.(*HTTPOrigin).CacheDir = dir
+	i, err := randImg(d, p)
+	assert.Nil(t, err)
+	assert.Equal(t, srv.URL+"/original-1.jpg", i.Name)
+
+	_, err = randImg(d, srv.URL+"/missing.txt")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,306 @@
+package placer
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/url"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+// LabelStyle is how a label is kept readable over the image.
+type LabelStyle string
+
+const (
+	// LabelOutline rings the text with a contrasting color.
+	LabelOutline LabelStyle = "outline"
+	// LabelBackdrop draws the text on a translucent contrasting box.
+	LabelBackdrop LabelStyle = "backdrop"
+)
+
+// maxLabelText bounds the length, in characters, of a label's text.
+const maxLabelText = 100
+
+// Label is text drawn over a rendition, sized to fit it.
+type Label struct {
+	// Text defaults to the rendition's dimensions, such as 300×200.
+	Text string
+	// Position is where the label sits, centered by default.
+	Position imaging.Anchor
+	// Color is the text color, white if nil. The outline or backdrop
+	// is black or white, whichever contrasts with it.
+	Color color.Color
+	Style LabelStyle
+}
+
+// ParseLabel reads a label from query parameters: ?label draws the
+// dimensions and ?text= a string of its own, placed and colored by
+// ?label_position=, ?label_color= and ?label_style=. It returns nil when no
+// label was asked for.
+func ParseLabel(q url.Values) (*Label, error) {
+	on, err := parseFlag(q, "label")
+	if err != nil {
+		return nil, err
+	}
+	l := &Label{Text: q.Get("text"), Style: LabelOutline}
+	if !on && l.Text == "" {
+		return nil, nil
+	}
+	if utf8.RuneCountInString(l.Text) > maxLabelText {
+		return nil, fmt.Errorf("text is longer than %d characters", maxLabelText)
+	}
+	if l.Position, err = ParseAnchor(q.Get("label_position")); err != nil {
+		return nil, err
+	}
+	if v := q.Get("label_color"); v != "" {
+		if l.Color, err = ParseColor(v); err != nil {
+			return nil, err
+		}
+	}
+	switch s := LabelStyle(q.Get("label_style")); s {
+	case "":
+	case LabelOutline, LabelBackdrop:
+		l.Style = s
+	default:
+		return nil, fmt.Errorf("invalid label style %q, expected outline or backdrop", s)
+	}
+	return l, nil
+}
+
+// Apply draws the label, making Label a Transform.
+func (l *Label) Apply(img image.Image) image.Image {
+	b := img.Bounds()
+	text := l.Text
+	if text == "" {
+		text = fmt.Sprintf("%d×%d", b.Dx(), b.Dy())
+	}
+	mask, err := labelMask(text, b.Dx(), b.Dy())
+	if err != nil || mask == nil {
+		return img
+	}
+
+	dst := imaging.Clone(img)
+	fg := l.color()
+	bg := contrasting(fg)
+	size := mask.Bounds().Size()
+	pad := int(math.Max(1, float64(size.Y)/8))
+	box := anchorRect(dst.Bounds().Inset(pad), size, l.Position)
+
+	if l.Style == LabelBackdrop {
+		backdrop := color.NRGBAModel.Convert(bg).(color.NRGBA)
+		backdrop.A = 0x99
+		draw.Draw(dst, box, image.NewUniform(backdrop), image.Point{}, draw.Over)
+	} else {
+		draw.DrawMask(dst, box, image.NewUniform(bg), image.Point{}, outline(mask, labelOutline(size.Y)), image.Point{}, draw.Over)
+	}
+	draw.DrawMask(dst, box, image.NewUniform(fg), image.Point{}, mask, image.Point{}, draw.Over)
+	return dst
+}
+
+// Key names the label for cache names. The text is hashed, as it may hold
+// anything.
+func (l *Label) Key() string {
+	text := "dims"
+	if l.Text != "" {
+		sum := sha1.Sum([]byte(l.Text))
+		text = hex.EncodeToString(sum[:6])
+	}
+	style := l.Style
+	if style == "" {
+		style = LabelOutline
+	}
+	return fmt.Sprintf("label-%s-%s-%s-%s", text, anchorName(l.Position), colorHex(l.color()), style)
+}
+
+func (l *Label) color() color.Color {
+	if l.Color == nil {
+		return color.White
+	}
+	return l.Color
+}
+
+// contrasting returns black for light colors and white for dark ones.
+func contrasting(c color.Color) color.Color {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	if 0.299*float64(n.R)+0.587*float64(n.G)+0.114*float64(n.B) > 140 {
+		return color.Black
+	}
+	return color.White
+}
+
+// anchorRect places a box of the given size inside b.
+func anchorRect(b image.Rectangle, size image.Point, a imaging.Anchor) image.Rectangle {
+	x := b.Min.X + (b.Dx()-size.X)/2
+	y := b.Min.Y + (b.Dy()-size.Y)/2
+	switch a {
+	case imaging.TopLeft, imaging.Left, imaging.BottomLeft:
+		x = b.Min.X
+	case imaging.TopRight, imaging.Right, imaging.BottomRight:
+		x = b.Max.X - size.X
+	}
+	switch a {
+	case imaging.TopLeft, imaging.Top, imaging.TopRight:
+		y = b.Min.Y
+	case imaging.BottomLeft, imaging.Bottom, imaging.BottomRight:
+		y = b.Max.Y - size.Y
+	}
+	return image.Rectangle{Min: image.Pt(x, y), Max: image.Pt(x+size.X, y+size.Y)}
+}
+
+var (
+	labelFontOnce sync.Once
+	labelFont     *sfnt.Font
+	labelFontErr  error
+)
+
+// labelOutline is the width of a label's outline, for a mask h pixels tall.
+func labelOutline(h int) int {
+	return int(math.Max(1, float64(h)/24))
+}
+
+// labelText measures and draws text in Go Bold at a size in pixels per em.
+type labelText struct {
+	font *sfnt.Font
+	buf  sfnt.Buffer
+	ppem fixed.Int26_6
+}
+
+// newLabelText returns Go Bold at the size that makes text fill most of the
+// width of a w by h image without getting taller than a fifth of it, or nil
+// if that is too small to draw.
+func newLabelText(text string, w int, h int) (*labelText, error) {
+	labelFontOnce.Do(func() {
+		labelFont, labelFontErr = sfnt.Parse(gobold.TTF)
+	})
+	if labelFontErr != nil {
+		return nil, labelFontErr
+	}
+	// measured at a reference size, as sizes scale linearly
+	const ref = 100
+	t := &labelText{font: labelFont, ppem: fixed.I(ref)}
+	width, height, err := t.size(text)
+	if err != nil || width == 0 {
+		return nil, err
+	}
+	scale := math.Min(0.8*float64(w)/float64(width), 0.2*float64(h)/float64(height))
+	if scale*ref < 1 {
+		return nil, nil
+	}
+	t.ppem = fixed.Int26_6(scale * ref * 64)
+	return t, nil
+}
+
+// size returns the advance of text and the height of a line.
+func (t *labelText) size(text string) (int, int, error) {
+	m, err := t.font.Metrics(&t.buf, t.ppem, font.HintingNone)
+	if err != nil {
+		return 0, 0, err
+	}
+	var advance fixed.Int26_6
+	t.glyphs(text, func(x sfnt.GlyphIndex, dot fixed.Int26_6, a fixed.Int26_6) {
+		advance = dot + a
+	})
+	return advance.Ceil(), (m.Ascent + m.Descent).Ceil(), nil
+}
+
+// glyphs calls fn with each glyph of text, where it starts and its advance.
+func (t *labelText) glyphs(text string, fn func(x sfnt.GlyphIndex, dot fixed.Int26_6, advance fixed.Int26_6)) {
+	var dot fixed.Int26_6
+	prev := sfnt.GlyphIndex(0)
+	for i, r := range text {
+		x, err := t.font.GlyphIndex(&t.buf, r)
+		if err != nil {
+			continue
+		}
+		if i > 0 {
+			if k, err := t.font.Kern(&t.buf, prev, x, t.ppem, font.HintingNone); err == nil {
+				dot += k
+			}
+		}
+		a, err := t.font.GlyphAdvance(&t.buf, x, t.ppem, font.HintingNone)
+		if err != nil {
+			continue
+		}
+		fn(x, dot, a)
+		dot += a
+		prev = x
+	}
+}
+
+// labelMask rasterizes text sized for a w by h image, with room around it
+// for an outline. The text shows through the mask's alpha channel. It
+// returns nil if the text is too small to draw.
+func labelMask(text string, w int, h int) (*image.Alpha, error) {
+	t, err := newLabelText(text, w, h)
+	if err != nil || t == nil {
+		return nil, err
+	}
+	width, height, err := t.size(text)
+	if err != nil {
+		return nil, err
+	}
+	m, err := t.font.Metrics(&t.buf, t.ppem, font.HintingNone)
+	if err != nil {
+		return nil, err
+	}
+	r := labelOutline(height)
+	mask := image.NewAlpha(image.Rect(0, 0, width+2*r, height+2*r))
+	z := vector.NewRasterizer(mask.Bounds().Dx(), mask.Bounds().Dy())
+	baseline := float32(r) + float32(m.Ascent)/64
+	t.glyphs(text, func(x sfnt.GlyphIndex, dot fixed.Int26_6, _ fixed.Int26_6) {
+		segments, err := t.font.LoadGlyph(&t.buf, x, t.ppem, nil)
+		if err != nil {
+			return
+		}
+		ox := float32(r) + float32(dot)/64
+		pt := func(p fixed.Point26_6) (float32, float32) {
+			return ox + float32(p.X)/64, baseline + float32(p.Y)/64
+		}
+		for _, seg := range segments {
+			switch seg.Op {
+			case sfnt.SegmentOpMoveTo:
+				z.MoveTo(pt(seg.Args[0]))
+			case sfnt.SegmentOpLineTo:
+				z.LineTo(pt(seg.Args[0]))
+			case sfnt.SegmentOpQuadTo:
+				x1, y1 := pt(seg.Args[0])
+				x2, y2 := pt(seg.Args[1])
+				z.QuadTo(x1, y1, x2, y2)
+			case sfnt.SegmentOpCubeTo:
+				x1, y1 := pt(seg.Args[0])
+				x2, y2 := pt(seg.Args[1])
+				x3, y3 := pt(seg.Args[2])
+				z.CubeTo(x1, y1, x2, y2, x3, y3)
+			}
+		}
+		z.ClosePath()
+	})
+	z.DrawOp = draw.Src
+	z.Draw(mask, mask.Bounds(), image.Opaque, image.Point{})
+	return mask, nil
+}
+
+// outline dilates mask by r pixels, drawing it once at each of 8 points
+// around a circle. Going around the circle rather than filling it keeps the
+// cost independent of r.
+func outline(mask *image.Alpha, r int) *image.Alpha {
+	out := image.NewAlpha(mask.Bounds())
+	for i := 0; i < 8; i++ {
+		a := float64(i) * math.Pi / 4
+		off := image.Pt(int(math.Round(float64(r)*math.Cos(a))), int(math.Round(float64(r)*math.Sin(a))))
+		draw.Draw(out, mask.Bounds().Add(off), mask, image.Point{}, draw.Over)
+	}
+	return out
+}
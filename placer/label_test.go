@@ -0,0 +1,106 @@
+package placer
+
+import (
+	"image"
+	"image/color"
+	"net/url"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/colornames"
+)
+
+func TestParseLabel(t *testing.T) {
+	tt := []struct {
+		query    string
+		expected *Label
+		err      string
+	}{
+		{query: "", expected: nil},
+		{query: "label=false", expected: nil},
+		{query: "label", expected: &Label{Style: LabelOutline}},
+		{query: "text=hi&label_position=top-left&label_style=backdrop", expected: &Label{Text: "hi", Position: imaging.TopLeft, Style: LabelBackdrop}},
+		{query: "label&label_color=red", expected: &Label{Color: colornames.Red, Style: LabelOutline}},
+		{query: "label=maybe", err: `invalid label "maybe", expected true or false`},
+		{query: "label&label_position=middle", err: "unknown anchor \"middle\", expected one of bottom, bottom-left, bottom-right, center, left, right, top, top-left, top-right"},
+		{query: "label&label_style=shadow", err: `invalid label style "shadow", expected outline or backdrop`},
+		{query: "text=" + string(make([]byte, 101)), err: "text is longer than 100 characters"},
+	}
+	for _, table := range tt {
+		q, err := url.ParseQuery(table.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := ParseLabel(q)
+		if table.err != "" {
+			if assert.NotNil(t, err, table.query) {
+				assert.Equal(t, table.err, err.Error())
+			}
+			continue
+		}
+		assert.Nil(t, err, table.query)
+		assert.Equal(t, table.expected, l, table.query)
+	}
+}
+
+func TestLabelKey(t *testing.T) {
+	assert.Equal(t, "label-dims-center-ffffff-outline", (&Label{}).Key())
+	assert.Equal(t, "label-dims-bottom-ff0000-backdrop", (&Label{Position: imaging.Bottom, Color: colornames.Red, Style: LabelBackdrop}).Key())
+	assert.NotEqual(t, (&Label{Text: "a/b"}).Key(), (&Label{Text: "a/c"}).Key())
+	assert.NotContains(t, (&Label{Text: "a/b"}).Key(), "/", "text is hashed so it can't escape the cache directory")
+	assert.Equal(t, []string{"fill", "center", "label-dims-center-ffffff-outline"}, Options{
+		Width:  300,
+		Height: 200,
+		Label:  &Label{},
+	}.variant(nil))
+}
+
+func TestLabelApply(t *testing.T) {
+	black := color.NRGBA{A: 255}
+	src := imaging.New(300, 200, black)
+	tt := []struct {
+		name   string
+		label  Label
+		inside image.Rectangle
+	}{
+		{name: "centered dimensions", label: Label{}, inside: image.Rect(0, 50, 300, 150)},
+		{name: "text at the top left", label: Label{Text: "hi", Position: imaging.TopLeft}, inside: image.Rect(0, 0, 150, 100)},
+		{name: "backdrop at the bottom", label: Label{Text: "hi", Position: imaging.Bottom, Style: LabelBackdrop}, inside: image.Rect(0, 100, 300, 200)},
+	}
+	for _, table := range tt {
+		img := table.label.Apply(src)
+		assert.Equal(t, src.Bounds(), img.Bounds(), table.name)
+		drawn := image.Rectangle{}
+		for y := 0; y < 200; y++ {
+			for x := 0; x < 300; x++ {
+				if img.At(x, y) != black {
+					drawn = drawn.Union(image.Rect(x, y, x+1, y+1))
+				}
+			}
+		}
+		assert.False(t, drawn.Empty(), table.name)
+		assert.True(t, drawn.In(table.inside), "%s: drawn at %v", table.name, drawn)
+	}
+
+	// the font shrinks to fit narrow images
+	narrow := (&Label{Text: "a long line of text"}).Apply(imaging.New(60, 200, black))
+	assert.Equal(t, image.Pt(60, 200), narrow.Bounds().Size())
+	assert.Equal(t, black, narrow.At(0, 100), "text should keep clear of the edges")
+}
+
+func TestContrasting(t *testing.T) {
+	assert.Equal(t, color.Black, contrasting(color.White))
+	assert.Equal(t, color.Black, contrasting(colornames.Yellow))
+	assert.Equal(t, color.White, contrasting(colornames.Navy))
+}
+
+func TestOutline(t *testing.T) {
+	mask := image.NewAlpha(image.Rect(0, 0, 9, 9))
+	mask.SetAlpha(4, 4, color.Alpha{A: 255})
+	out := outline(mask, 3)
+	for _, p := range []image.Point{{7, 4}, {1, 4}, {4, 7}, {4, 1}, {6, 6}, {2, 2}} {
+		assert.Equal(t, uint8(255), out.AlphaAt(p.X, p.Y).A, "outline at %v", p)
+	}
+	assert.Equal(t, uint8(0), out.AlphaAt(4, 4).A, "the outline only surrounds the mask")
+}
@@ -0,0 +1,466 @@
+package placer
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned when no original matches a request.
+var ErrNotFound = errors.New("no matching image")
+
+// Library is an in-memory index of the originals under a path. It is built
+// once and then refreshed by Reload or Poll, so picking an image never has to
+// go back to the backend.
+type Library struct {
+	Path    string
+	list    func(string) ([]Image, error)
+	modTime func(string) (time.Time, error)
+	// open, when set, reads the MetadataFile sidecar.
+	open func(string, Image) (io.ReadCloser, error)
+	// head, when set, reads at least the first headerBytes of an original,
+	// for measure. Backends that learn dimensions while listing leave it
+	// unset.
+	head func(string, Image) (io.ReadCloser, error)
+	// ttl, when set, refreshes the index in the background once it is
+	// older than ttl.
+	ttl time.Duration
+	// commit, when set, is told whether a reload succeeded, right before
+	// its index is published, so the backend can publish or discard state
+	// it built while listing.
+	commit func(string, error)
+
+	mu         sync.RWMutex
+	images     []Image
+	byID       map[string]int
+	stamp      time.Time
+	checked    time.Time
+	refreshing bool
+}
+
+// NewLibrary returns an empty library that indexes path with list. Call
+// Reload to build the index.
+func NewLibrary(path string, list func(string) ([]Image, error)) *Library {
+	return &Library{Path: path, list: list}
+}
+
+// Reload rebuilds the index from the backend. The previous index is kept if
+// listing fails.
+func (l *Library) Reload() error {
+	images, stamp, err := l.index()
+	if l.commit != nil {
+		l.commit(l.Path, err)
+	}
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]int, len(images))
+	for i := range images {
+		images[i].ID = imageID(images[i].Name)
+		byID[images[i].ID] = i
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.images = images
+	l.byID = byID
+	l.stamp = stamp
+	return nil
+}
+
+// index lists the backend and reads the originals' metadata and dimensions,
+// returning them sorted by name with the backend's modification time.
+func (l *Library) index() ([]Image, time.Time, error) {
+	var stamp time.Time
+	var stampErr error
+	if l.modTime != nil {
+		// taken before listing, so a change made while we list isn't missed
+		stamp, stampErr = l.modTime(l.Path)
+	}
+	images, err := l.list(l.Path)
+	l.mu.Lock()
+	l.checked = time.Now()
+	l.mu.Unlock()
+	if err != nil {
+		return nil, stamp, err
+	}
+	if stampErr != nil {
+		return nil, stamp, stampErr
+	}
+	if err := l.readMetadata(images); err != nil {
+		return nil, stamp, err
+	}
+	l.measure(images)
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Name < images[j].Name
+	})
+	return images, stamp, nil
+}
+
+// readMetadata applies the library's sidecar to images. A missing or
+// unreadable sidecar just means there is no metadata; a malformed one is an
+// error so curators find out about it.
+func (l *Library) readMetadata(images []Image) error {
+	if l.open == nil {
+		return nil
+	}
+	rc, err := l.open(l.Path, Image{Name: MetadataFile})
+	if err != nil {
+		return nil
+	}
+	defer rc.Close()
+	m, err := readMetadata(rc)
+	if err != nil {
+		return err
+	}
+	applyMetadata(images, m)
+	return nil
+}
+
+// measureWorkers bounds how many originals are opened at once to read their
+// dimensions.
+const measureWorkers = 8
+
+// headerBytes is how much of an original measure reads, which is plenty for
+// the headers of the formats we decode, even behind a large EXIF block.
+const headerBytes = 64 << 10
+
+// measure records the dimensions of images from their headers, unless they
+// were listed with them. Dimensions already in the index are reused as long
+// as the original's version is unchanged, so a reload only reads new
+// originals.
+func (l *Library) measure(images []Image) {
+	if l.head == nil {
+		return
+	}
+	l.mu.RLock()
+	known := make(map[string]Image, len(l.images))
+	for _, i := range l.images {
+		known[i.Name] = i
+	}
+	l.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, measureWorkers)
+	for n := range images {
+		i := &images[n]
+		if i.Width > 0 {
+			continue
+		}
+		if k, ok := known[i.Name]; ok && k.version() == i.version() && k.Width > 0 {
+			i.Width, i.Height = k.Width, k.Height
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			rc, err := l.head(l.Path, *i)
+			if err != nil {
+				return
+			}
+			defer rc.Close()
+			if c, _, err := image.DecodeConfig(io.LimitReader(rc, headerBytes)); err == nil {
+				i.Width, i.Height = c.Width, c.Height
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Changed reports whether the backend was modified since the last reload.
+// Backends that can't tell always report a change.
+func (l *Library) Changed() (bool, error) {
+	if l.modTime == nil {
+		return true, nil
+	}
+	stamp, err := l.modTime(l.Path)
+	if err != nil {
+		return false, err
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return !stamp.Equal(l.stamp), nil
+}
+
+// Watchable reports whether Changed can tell if the backend was modified, so
+// polling is worth it. Other libraries are kept fresh by their ttl, if any,
+// or by reloading them.
+func (l *Library) Watchable() bool {
+	return l.modTime != nil
+}
+
+// Poll reloads the library every interval when the backend has changed,
+// until stop is closed. Errors are passed to errs, if it is not nil, and the
+// previous index is kept.
+func (l *Library) Poll(interval time.Duration, stop <-chan struct{}, errs func(error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		changed, err := l.Changed()
+		if err == nil && changed {
+			err = l.Reload()
+		}
+		if err != nil && errs != nil {
+			errs(err)
+		}
+	}
+}
+
+// refresh kicks off a background reload once the index is older than the
+// library's ttl. A failed refresh keeps the old index and is retried after
+// another ttl.
+func (l *Library) refresh() {
+	if l.ttl <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.refreshing || time.Since(l.checked) < l.ttl {
+		return
+	}
+	l.refreshing = true
+	go func() {
+		l.Reload()
+		l.mu.Lock()
+		l.refreshing = false
+		l.mu.Unlock()
+	}()
+}
+
+// Images returns the indexed originals, sorted by name.
+func (l *Library) Images() []Image {
+	l.refresh()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return append([]Image(nil), l.images...)
+}
+
+// Rand returns a random original from the index, or ErrNotFound if there are
+// none.
+func (l *Library) Rand() (Image, error) {
+	l.refresh()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if len(l.images) == 0 {
+		return Image{}, ErrNotFound
+	}
+	return l.images[rand.Intn(len(l.images))], nil
+}
+
+// Get returns the original with the given ID, or ErrNotFound.
+func (l *Library) Get(id string) (Image, error) {
+	l.refresh()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	i, ok := l.byID[id]
+	if !ok {
+		return Image{}, ErrNotFound
+	}
+	return l.images[i], nil
+}
+
+// Tagged returns the originals carrying all of tags, sorted by name.
+func (l *Library) Tagged(tags ...string) []Image {
+	images := l.Images()
+	tags = normalizeTags(tags)
+	if len(tags) == 0 {
+		return images
+	}
+	matched := []Image{}
+	for _, i := range images {
+		if hasTags(i, tags) {
+			matched = append(matched, i)
+		}
+	}
+	return matched
+}
+
+// Select picks an original carrying all of the options' tags, or returns
+// ErrNotFound if there are none. Among those, originals at least as large as
+// the requested dimensions, and then those shaped most like them, are
+// preferred. With a seed the pick is a hash of it, so the same seed keeps
+// picking the same original for as long as the library is unchanged;
+// without one it is random.
+func (l *Library) Select(o Options) (Image, error) {
+	l.refresh()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	// the candidates are narrowed down in passes over the index rather than
+	// by copying it on every request
+	tags := normalizeTags(o.Tags)
+	w, h := o.size()
+	if len(tags) == 0 && w <= 0 && h <= 0 {
+		// every original is a candidate
+		if len(l.images) == 0 {
+			return Image{}, ErrNotFound
+		}
+		return l.images[pick(o.Seed, len(l.images))], nil
+	}
+	tagged, large := 0, 0
+	for _, i := range l.images {
+		if hasTags(i, tags) {
+			tagged++
+			if i.covers(w, h) {
+				large++
+			}
+		}
+	}
+	if tagged == 0 {
+		if len(o.Tags) > 0 {
+			return Image{}, fmt.Errorf("%w tagged %s", ErrNotFound, strings.Join(o.Tags, ", "))
+		}
+		return Image{}, ErrNotFound
+	}
+	// originals that would be scaled up are only picked if nothing is large
+	// enough
+	sized := func(i Image) bool {
+		return hasTags(i, tags) && (large == 0 || i.covers(w, h))
+	}
+	best := math.Inf(1)
+	for _, i := range l.images {
+		if sized(i) {
+			best = math.Min(best, aspectDistance(i, w, h))
+		}
+	}
+	// originals with unknown dimensions are only picked if no dimensions
+	// are known at all
+	matches := func(i Image) bool {
+		return sized(i) && (math.IsInf(best, 1) || aspectDistance(i, w, h) <= best+math.Log(aspectTolerance))
+	}
+	n := 0
+	for _, i := range l.images {
+		if matches(i) {
+			n++
+		}
+	}
+	k := pick(o.Seed, n)
+	for _, i := range l.images {
+		if matches(i) {
+			if k == 0 {
+				return i, nil
+			}
+			k--
+		}
+	}
+	return Image{}, ErrNotFound
+}
+
+// pick returns which of n candidates a seed picks, or a random one without a
+// seed.
+func pick(seed string, n int) int {
+	if seed == "" {
+		return rand.Intn(n)
+	}
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	return int(h.Sum64() % uint64(n))
+}
+
+// aspectTolerance is how much wider or narrower than the best match among
+// the candidates an original may be and still be picked.
+const aspectTolerance = 1.25
+
+// aspectDistance is how far the original's aspect ratio is from w by h, or
+// infinite if either isn't known.
+func aspectDistance(i Image, w int, h int) float64 {
+	if w <= 0 || h <= 0 || i.Width <= 0 || i.Height <= 0 {
+		return math.Inf(1)
+	}
+	return math.Abs(math.Log(float64(i.Width) / float64(i.Height) / (float64(w) / float64(h))))
+}
+
+// hasTags reports whether i carries all of tags, which must be normalized.
+func hasTags(i Image, tags []string) bool {
+	for _, tag := range tags {
+		n := sort.SearchStrings(i.Tags, tag)
+		if n == len(i.Tags) || i.Tags[n] != tag {
+			return false
+		}
+	}
+	return true
+}
+
+// imageID derives a short, URL safe ID from an original's name, which may be
+// a nested key or a URL that wouldn't fit in a path segment. It only depends
+// on the name, so pinned URLs survive the original being replaced or
+// touched; the original's version goes into cache keys instead.
+func imageID(name string) string {
+	sum := sha1.Sum([]byte(name))
+	return hex.EncodeToString(sum[:6])
+}
+
+// libraries lazily builds and remembers one Library per path, for Directory
+// implementations to embed.
+type libraries struct {
+	mu      sync.Mutex
+	m       map[string]*Library
+	pending map[string]*pendingLibrary
+}
+
+// pendingLibrary is a library being indexed, which concurrent callers wait
+// for rather than indexing it again.
+type pendingLibrary struct {
+	done chan struct{}
+	l    *Library
+	err  error
+}
+
+// get returns the library for p, indexing it on first use. Indexing happens
+// without holding the lock, so a slow or failing backend doesn't hold up
+// other paths, and a failed index is retried by the next call.
+func (ls *libraries) get(p string, newLib func(string) *Library) (*Library, error) {
+	ls.mu.Lock()
+	if l, ok := ls.m[p]; ok {
+		ls.mu.Unlock()
+		return l, nil
+	}
+	if pl, ok := ls.pending[p]; ok {
+		ls.mu.Unlock()
+		<-pl.done
+		return pl.l, pl.err
+	}
+	pl := &pendingLibrary{done: make(chan struct{})}
+	if ls.pending == nil {
+		ls.pending = map[string]*pendingLibrary{}
+	}
+	ls.pending[p] = pl
+	ls.mu.Unlock()
+
+	l := newLib(p)
+	if err := l.Reload(); err != nil {
+		pl.err = err
+	} else {
+		pl.l = l
+	}
+
+	ls.mu.Lock()
+	delete(ls.pending, p)
+	if pl.err == nil {
+		if ls.m == nil {
+			ls.m = map[string]*Library{}
+		}
+		ls.m[p] = l
+	}
+	ls.mu.Unlock()
+	close(pl.done)
+	return pl.l, pl.err
+}
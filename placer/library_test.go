@@ -0,0 +1,309 @@
+package placer
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLibraryReload(t *testing.T) {
+	calls := 0
+	images := []Image{{Name: "original-b.jpg"}, {Name: "original-a.jpg"}}
+	var listErr error
+	l := NewLibrary("chickens", func(p string) ([]Image, error) {
+		calls++
+		assert.Equal(t, "chickens", p)
+		return images, listErr
+	})
+
+	img, err := l.Rand()
+	assert.Equal(t, ErrNotFound, err, "an empty library has nothing to pick")
+	assert.Equal(t, Image{}, img)
+
+	assert.Nil(t, l.Reload())
+	assert.Equal(t, []Image{
+		{ID: imageID("original-a.jpg"), Name: "original-a.jpg"},
+		{ID: imageID("original-b.jpg"), Name: "original-b.jpg"},
+	}, l.Images())
+	for i := 0; i < 10; i++ {
+		img, err := l.Rand()
+		assert.Nil(t, err)
+		assert.Contains(t, images, img)
+	}
+	assert.Equal(t, 1, calls, "picking shouldn't list the backend")
+
+	listErr = errors.New("backend down")
+	assert.Equal(t, listErr, l.Reload())
+	assert.Equal(t, 2, len(l.Images()), "a failed reload keeps the old index")
+}
+
+func TestLibrarySelection(t *testing.T) {
+	images := []Image{{Name: "original-a.jpg"}, {Name: "original-b.jpg"}, {Name: "original-c.jpg"}}
+	l := NewLibrary("chickens", func(string) ([]Image, error) {
+		return append([]Image(nil), images...), nil
+	})
+	_, err := l.Select(Options{Seed: "anything"})
+	assert.Equal(t, ErrNotFound, err, "an empty library has nothing to pick")
+	assert.Nil(t, l.Reload())
+
+	img, err := l.Get(imageID("original-b.jpg"))
+	assert.Nil(t, err)
+	assert.Equal(t, "original-b.jpg", img.Name)
+	_, err = l.Get("bogus")
+	assert.Equal(t, ErrNotFound, err)
+
+	picked := map[string]bool{}
+	for _, seed := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		first, err := l.Select(Options{Seed: seed})
+		assert.Nil(t, err)
+		again, _ := l.Select(Options{Seed: seed})
+		assert.Equal(t, first, again, "a seed should always pick the same image")
+		picked[first.Name] = true
+	}
+	assert.True(t, len(picked) > 1, "seeds should spread over the library")
+
+	// listing order doesn't matter, only the library's contents
+	images[0], images[2] = images[2], images[0]
+	before, _ := l.Select(Options{Seed: "a"})
+	assert.Nil(t, l.Reload())
+	after, _ := l.Select(Options{Seed: "a"})
+	assert.Equal(t, before, after)
+}
+
+func TestLibraryTags(t *testing.T) {
+	l := NewLibrary("chickens", func(string) ([]Image, error) {
+		return []Image{
+			{Name: "chicks/original-1.jpg", Tags: []string{"chicks"}},
+			{Name: "chicks/original-2.jpg", Tags: []string{"brown", "chicks"}},
+			{Name: "roosters/original-3.jpg", Tags: []string{"brown", "roosters"}},
+		}, nil
+	})
+	assert.Nil(t, l.Reload())
+
+	assert.Equal(t, 3, len(l.Tagged()))
+	assert.Equal(t, 2, len(l.Tagged("chicks")))
+	assert.Equal(t, 2, len(l.Tagged("Brown")), "tags are matched case insensitively")
+	brownChicks := l.Tagged("chicks", "brown")
+	if assert.Equal(t, 1, len(brownChicks), "all tags should match") {
+		assert.Equal(t, "chicks/original-2.jpg", brownChicks[0].Name)
+	}
+
+	for i := 0; i < 10; i++ {
+		img, err := l.Select(Options{Tags: []string{"roosters"}})
+		assert.Nil(t, err)
+		assert.Equal(t, "roosters/original-3.jpg", img.Name)
+	}
+	_, err := l.Select(Options{Tags: []string{"ducks"}})
+	if assert.NotNil(t, err) {
+		assert.True(t, errors.Is(err, ErrNotFound))
+		assert.Equal(t, "no matching image tagged ducks", err.Error())
+	}
+}
+
+func TestImageID(t *testing.T) {
+	assert.Equal(t, imageID("original-a.jpg"), imageID("original-a.jpg"))
+	assert.NotEqual(t, imageID("original-b.jpg"), imageID("original-a.jpg"))
+
+	modified := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	l := NewLibrary("chickens", func(string) ([]Image, error) {
+		return []Image{{Name: "original-a.jpg", Size: 100, ModTime: modified}}, nil
+	})
+	assert.Nil(t, l.Reload())
+	id := l.Images()[0].ID
+	modified = modified.Add(time.Hour)
+	assert.Nil(t, l.Reload())
+	assert.Equal(t, id, l.Images()[0].ID, "a replaced original keeps its ID")
+}
+
+func TestLibraryMeasure(t *testing.T) {
+	opened := 0
+	d := &Dir{}
+	l := NewLibrary("../static/images/test/", d.list)
+	l.open = d.Open
+	l.head = func(p string, i Image) (io.ReadCloser, error) {
+		opened++
+		return d.Open(p, i)
+	}
+	assert.Nil(t, l.Reload())
+	img := l.Images()[0]
+	assert.Equal(t, 2160, img.Width)
+	assert.Equal(t, 1440, img.Height)
+	assert.Equal(t, 1, opened)
+
+	assert.Nil(t, l.Reload())
+	assert.Equal(t, img, l.Images()[0])
+	assert.Equal(t, 1, opened, "unchanged originals shouldn't be read again")
+
+	listed := NewLibrary("chickens", func(string) ([]Image, error) {
+		return []Image{{Name: "original-a.jpg", Width: 300, Height: 200}}, nil
+	})
+	listed.head = func(string, Image) (io.ReadCloser, error) {
+		t.Fatal("originals listed with dimensions shouldn't be read")
+		return nil, nil
+	}
+	assert.Nil(t, listed.Reload())
+	assert.Equal(t, 300, listed.Images()[0].Width)
+}
+
+// randImg picks a random original from the directory's index at p.
+func randImg(d Directory, p string) (Image, error) {
+	lib, err := d.Library(p)
+	if err != nil {
+		return Image{}, err
+	}
+	return lib.Rand()
+}
+
+func TestLibrarySelectAspect(t *testing.T) {
+	images := []Image{
+		{Name: "landscape", Width: 1500, Height: 1000},
+		{Name: "wide", Width: 1600, Height: 1000},
+		{Name: "portrait", Width: 1000, Height: 1500},
+		{Name: "strip", Width: 3000, Height: 500},
+		{Name: "unknown"},
+	}
+	l := NewLibrary("chickens", func(string) ([]Image, error) {
+		return images, nil
+	})
+	assert.Nil(t, l.Reload())
+	tt := []struct {
+		width    int
+		height   int
+		expected []string
+	}{
+		{width: 300, height: 200, expected: []string{"landscape", "wide"}},
+		{width: 200, height: 300, expected: []string{"portrait"}},
+		{width: 1200, height: 200, expected: []string{"strip"}},
+		{width: 300, expected: []string{"landscape", "portrait", "strip", "wide"}},
+	}
+	for _, table := range tt {
+		picked := map[string]bool{}
+		for i := 0; i < 50; i++ {
+			img, err := l.Select(Options{Width: table.width, Height: table.height})
+			assert.Nil(t, err)
+			picked[img.Name] = true
+		}
+		for name := range picked {
+			assert.Contains(t, table.expected, name, "%dx%d", table.width, table.height)
+		}
+	}
+
+	unknown := NewLibrary("chickens", func(string) ([]Image, error) {
+		return []Image{{Name: "unknown"}}, nil
+	})
+	assert.Nil(t, unknown.Reload())
+	img, err := unknown.Select(Options{Width: 300, Height: 200})
+	assert.Nil(t, err)
+	assert.Equal(t, "unknown", img.Name, "unknown dimensions are kept when nothing is known")
+}
+
+func TestLibrarySelectSize(t *testing.T) {
+	l := NewLibrary("chickens", func(string) ([]Image, error) {
+		return []Image{
+			{Name: "small", Width: 600, Height: 400},
+			{Name: "large", Width: 2400, Height: 1600},
+			{Name: "large-portrait", Width: 1600, Height: 2400},
+		}, nil
+	})
+	assert.Nil(t, l.Reload())
+
+	for i := 0; i < 10; i++ {
+		img, err := l.Select(Options{Width: 1200, Height: 800})
+		assert.Nil(t, err)
+		assert.Equal(t, "large", img.Name, "originals that need scaling up shouldn't be picked")
+		img, err = l.Select(Options{Width: 300, Height: 200})
+		assert.Nil(t, err)
+		assert.NotEqual(t, "large-portrait", img.Name)
+		img, err = l.Select(Options{Width: 2000})
+		assert.Nil(t, err)
+		assert.Equal(t, "large", img.Name)
+	}
+	img, err := l.Select(Options{Width: 4000, Height: 4000})
+	assert.Nil(t, err, "with nothing large enough any original will do")
+	assert.NotEqual(t, "", img.Name)
+}
+
+func TestLibraryPoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "placechicken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := Dir{}
+	l, err := d.Library(dir)
+	assert.Nil(t, err)
+	assert.True(t, l.Watchable())
+	assert.Equal(t, 0, len(l.Images()))
+	changed, err := l.Changed()
+	assert.Nil(t, err)
+	assert.False(t, changed)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		l.Poll(10*time.Millisecond, stop, func(err error) { t.Error(err) })
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	// make sure the directory mtime moves even on coarse filesystems
+	time.Sleep(10 * time.Millisecond)
+	err = ioutil.WriteFile(filepath.Join(dir, "original-new.jpg"), []byte{}, 0644)
+	assert.Nil(t, err)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(l.Images()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	images := l.Images()
+	assert.Equal(t, 1, len(images))
+	if len(images) == 1 {
+		assert.Equal(t, "original-new.jpg", images[0].Name)
+	}
+}
+
+func TestLibrariesGet(t *testing.T) {
+	var ls libraries
+	listing := make(chan struct{})
+	release := make(chan struct{})
+	down := func(p string) *Library {
+		return NewLibrary(p, func(string) ([]Image, error) {
+			listing <- struct{}{}
+			<-release
+			return nil, errors.New("backend down")
+		})
+	}
+	errs := make(chan error)
+	go func() {
+		_, err := ls.get("ducks", down)
+		errs <- err
+	}()
+	<-listing
+
+	// another path isn't held up while ducks is being indexed
+	l, err := ls.get("chickens", func(p string) *Library {
+		return NewLibrary(p, func(string) ([]Image, error) {
+			return []Image{{Name: "original-a.jpg"}}, nil
+		})
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(l.Images()))
+
+	close(release)
+	assert.EqualError(t, <-errs, "backend down")
+	go func() { <-listing }()
+	_, err = ls.get("ducks", down)
+	assert.EqualError(t, err, "backend down", "a failed index is retried")
+	again, err := ls.get("chickens", nil)
+	assert.Nil(t, err)
+	assert.True(t, l == again)
+}
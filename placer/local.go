@@ -1,38 +1,116 @@
 package placer
 
 import (
+	"io"
 	"io/ioutil"
-	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 // Dir struct exists as a placeholder to allow abstracting os directory methods.
-type Dir struct{}
+// Originals in subdirectories are tagged with the subdirectories' names.
+type Dir struct {
+	// Exclude lists directories that are never indexed, such as a resized
+	// image cache kept under the originals.
+	Exclude []string
+	libraries
+}
 
-// RandImg gets the contents of a directory, filters it for only images, and
-// then returns a random image.
-func (d *Dir) RandImg(p string) (Image, error) {
-	files, err := d.list(p)
-	i := Image{}
-	if err != nil {
-		return i, err
-	}
+// Library returns the index of images in a directory, building it on first
+// use. The index notices files being added, removed or changed through the
+// modification times of the directories and the files in them.
+func (d *Dir) Library(p string) (*Library, error) {
+	return d.libraries.get(p, func(p string) *Library {
+		l := NewLibrary(p, d.list)
+		l.modTime = d.modTime
+		l.open = d.Open
+		l.head = d.Open
+		return l
+	})
+}
 
-	if len(files) > 0 {
-		randIdx := rand.Intn(len(files))
-		randFile := files[randIdx]
-		return randFile, nil
-	}
-	return i, nil
+// Open opens an image in the directory for reading.
+func (d *Dir) Open(p string, i Image) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(p, filepath.FromSlash(i.Name)))
 }
 
 func (d *Dir) list(p string) ([]Image, error) {
-	fileList, err := ioutil.ReadDir(p)
 	i := []Image{}
-	for _, file := range fileList {
+	err := d.walk(p, "", func(rel string, file os.FileInfo) {
 		if strings.Contains(file.Name(), "original") {
-			i = append(i, Image{Name: file.Name()})
+			i = append(i, Image{
+				Name:    rel,
+				Size:    file.Size(),
+				ModTime: file.ModTime(),
+				Tags:    dirTags(rel),
+			})
 		}
-	}
+	})
 	return i, err
 }
+
+// modTime returns the latest modification time of the directory and
+// everything under it, as replacing an original or editing the metadata
+// sidecar in place doesn't touch the directory.
+func (d *Dir) modTime(p string) (time.Time, error) {
+	t, err := statModTime(p)
+	if err != nil {
+		return t, err
+	}
+	err = d.walk(p, "", func(_ string, file os.FileInfo) {
+		if file.ModTime().After(t) {
+			t = file.ModTime()
+		}
+	})
+	return t, err
+}
+
+// walk calls fn with the slash separated path, relative to p, of every file
+// and directory under p, skipping hidden and excluded directories.
+func (d *Dir) walk(p string, rel string, fn func(string, os.FileInfo)) error {
+	dir := p
+	if rel != "" {
+		dir = filepath.Join(p, filepath.FromSlash(rel))
+	}
+	fileList, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range fileList {
+		name := path.Join(rel, file.Name())
+		if file.IsDir() && (strings.HasPrefix(file.Name(), ".") || d.excluded(filepath.Join(p, filepath.FromSlash(name)))) {
+			continue
+		}
+		fn(name, file)
+		if file.IsDir() {
+			if err := d.walk(p, name, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *Dir) excluded(dir string) bool {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	for _, ex := range d.Exclude {
+		if exAbs, err := filepath.Abs(ex); err == nil && exAbs == abs {
+			return true
+		}
+	}
+	return false
+}
+
+func statModTime(p string) (time.Time, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
@@ -2,7 +2,13 @@ package placer
 
 import (
 	"errors"
+	"image"
+	_ "image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -38,10 +44,107 @@ func TestDirGetRandomImage(t *testing.T) {
 
 	for _, table := range tt {
 		d := Dir{}
-		rImage, err := d.RandImg(table.path)
+		rImage, err := randImg(&d, table.path)
 		assert.Equal(t, table.expectedResult, rImage.Name)
 		if err != nil {
 			assert.Equal(t, table.expectedError.Error(), err.Error())
 		}
 	}
 }
+
+func TestDirLibraryIsShared(t *testing.T) {
+	d := Dir{}
+	a, err := d.Library("../static/images/test/")
+	assert.Nil(t, err)
+	b, err := d.Library("../static/images/test/")
+	assert.Nil(t, err)
+	assert.True(t, a == b, "the index should only be built once per path")
+	assert.Equal(t, 1, len(a.Images()))
+	assert.Equal(t, "original-test-image.jpg", a.Images()[0].Name)
+}
+
+func TestDirOpen(t *testing.T) {
+	d := Dir{}
+	i, err := randImg(&d, "../static/images/test")
+	assert.Nil(t, err)
+	assert.True(t, i.Size > 0)
+	rc, err := d.Open("../static/images/test", i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	_, format, err := image.DecodeConfig(rc)
+	assert.Nil(t, err)
+	assert.Equal(t, "jpeg", format)
+}
+
+func TestDirSubdirectories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "placechicken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{
+		"original-1.jpg",
+		"chicks/original-2.jpg",
+		"chicks/Fluffy/original-3.jpg",
+		"resized/original-1-300x200.jpg",
+		".hidden/original-4.jpg",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := Dir{Exclude: []string{filepath.Join(dir, "resized")}}
+	l, err := d.Library(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images := l.Images()
+	if assert.Equal(t, 3, len(images), "hidden and excluded directories are skipped") {
+		assert.Equal(t, "chicks/Fluffy/original-3.jpg", images[0].Name)
+		assert.Equal(t, []string{"chicks", "fluffy"}, images[0].Tags)
+		assert.Equal(t, "chicks/original-2.jpg", images[1].Name)
+		assert.Equal(t, []string{"chicks"}, images[1].Tags)
+		assert.Equal(t, "original-1.jpg", images[2].Name)
+		assert.Nil(t, images[2].Tags)
+	}
+
+	rc, err := d.Open(dir, images[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, "chicks/Fluffy/original-3.jpg", string(data))
+
+	// adding to a subdirectory is noticed, but the resized cache isn't
+	changed, err := l.Changed()
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "resized"), later, later)
+	changed, err = l.Changed()
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	os.Chtimes(filepath.Join(dir, "chicks", "Fluffy"), later, later)
+	changed, err = l.Changed()
+	assert.Nil(t, err)
+	assert.True(t, changed)
+
+	// so is replacing an original in place
+	if err := l.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "original-1.jpg"), later, later)
+	changed, err = l.Changed()
+	assert.Nil(t, err)
+	assert.True(t, changed)
+}
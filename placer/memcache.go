@@ -0,0 +1,101 @@
+package placer
+
+import (
+	"image"
+	"sync"
+)
+
+// MemCache keeps recently used decoded originals and encoded renditions in
+// memory, each bounded by its own byte limit.
+type MemCache struct {
+	mu         sync.Mutex
+	sources    *lru
+	renditions *lru
+	stats      CacheStats
+}
+
+// CacheStats counts MemCache lookups.
+type CacheStats struct {
+	SourceHits      uint64
+	SourceMisses    uint64
+	RenditionHits   uint64
+	RenditionMisses uint64
+}
+
+// NewMemCache returns a cache holding at most sourceBytes of decoded
+// originals and renditionBytes of encoded renditions.
+func NewMemCache(sourceBytes int64, renditionBytes int64) *MemCache {
+	return &MemCache{
+		sources:    newLRU(sourceBytes, nil),
+		renditions: newLRU(renditionBytes, nil),
+	}
+}
+
+// Source returns the decoded original stored under name.
+func (c *MemCache) Source(name string) (image.Image, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.sources.get(name)
+	if !ok {
+		c.stats.SourceMisses++
+		return nil, false
+	}
+	c.stats.SourceHits++
+	return v.(image.Image), true
+}
+
+// AddSource stores a decoded original under name.
+func (c *MemCache) AddSource(name string, img image.Image) {
+	c.add(c.sources, name, img, imageBytes(img))
+}
+
+// Rendition returns the encoded rendition stored under key.
+func (c *MemCache) Rendition(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.renditions.get(key)
+	if !ok {
+		c.stats.RenditionMisses++
+		return nil, false
+	}
+	c.stats.RenditionHits++
+	return v.([]byte), true
+}
+
+// AddRendition stores an encoded rendition under key.
+func (c *MemCache) AddRendition(key string, data []byte) {
+	c.add(c.renditions, key, data, int64(len(data)))
+}
+
+// Stats returns a snapshot of the hit and miss counters.
+func (c *MemCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func (c *MemCache) add(l *lru, key string, value interface{}, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if l.max > 0 && size > l.max {
+		// would only push everything else out before being evicted itself
+		return
+	}
+	l.add(key, value, size)
+}
+
+// imageBytes estimates how much memory a decoded image holds on to.
+func imageBytes(img image.Image) int64 {
+	switch i := img.(type) {
+	case *image.NRGBA:
+		return int64(len(i.Pix))
+	case *image.RGBA:
+		return int64(len(i.Pix))
+	case *image.Gray:
+		return int64(len(i.Pix))
+	case *image.YCbCr:
+		return int64(len(i.Y) + len(i.Cb) + len(i.Cr))
+	}
+	size := img.Bounds().Size()
+	return int64(size.X) * int64(size.Y) * 4
+}
@@ -0,0 +1,48 @@
+package placer
+
+import (
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemCacheRenditions(t *testing.T) {
+	c := NewMemCache(0, 8)
+	_, ok := c.Rendition("a")
+	assert.False(t, ok)
+
+	c.AddRendition("a", []byte("aaaa"))
+	c.AddRendition("b", []byte("bbbb"))
+	data, ok := c.Rendition("a")
+	assert.True(t, ok)
+	assert.Equal(t, "aaaa", string(data))
+
+	// b is now the least recently used and gets evicted
+	c.AddRendition("c", []byte("cccc"))
+	_, ok = c.Rendition("b")
+	assert.False(t, ok)
+
+	// too big to ever fit, so it shouldn't evict anything
+	c.AddRendition("d", []byte("ddddddddd"))
+	_, ok = c.Rendition("d")
+	assert.False(t, ok)
+	_, ok = c.Rendition("c")
+	assert.True(t, ok)
+
+	assert.Equal(t, CacheStats{RenditionHits: 2, RenditionMisses: 3}, c.Stats())
+}
+
+func TestMemCacheSources(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	c := NewMemCache(400, 0)
+	c.AddSource("a", img)
+	got, ok := c.Source("a")
+	assert.True(t, ok)
+	assert.Equal(t, img, got)
+
+	c.AddSource("b", img)
+	_, ok = c.Source("a")
+	assert.False(t, ok)
+	assert.Equal(t, CacheStats{SourceHits: 1, SourceMisses: 1}, c.Stats())
+}
@@ -0,0 +1,133 @@
+package placer
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"path"
+	"sort"
+	"strings"
+)
+
+// MetadataFile is the name of the sidecar file, kept alongside the
+// originals, that curators use to describe them. It maps image names to
+// their metadata:
+//
+//	{
+//	    "original-0143.jpg": {"focus": {"x": 0.45, "y": 0.2}, "tags": ["rooster"]}
+//	}
+const MetadataFile = "metadata.json"
+
+// Focus is the point of an original that crops should center on, such as a
+// bird's head, given as fractions of its width and height from the top left.
+type Focus struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// metadata is the sidecar entry for a single original.
+type metadata struct {
+	Focus *Focus   `json:"focus,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+}
+
+// readMetadata parses a sidecar file.
+func readMetadata(r io.Reader) (map[string]metadata, error) {
+	m := map[string]metadata{}
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", MetadataFile, err)
+	}
+	for name, meta := range m {
+		f := meta.Focus
+		if f != nil && (f.X < 0 || f.X > 1 || f.Y < 0 || f.Y > 1) {
+			return nil, fmt.Errorf("invalid %s: focus for %s must be between 0 and 1", MetadataFile, name)
+		}
+	}
+	return m, nil
+}
+
+// applyMetadata copies sidecar entries onto the images they describe,
+// matching on the full name first and then the base name, so entries work
+// whether or not a backend nests its keys.
+func applyMetadata(images []Image, m map[string]metadata) {
+	for i := range images {
+		meta, ok := m[images[i].Name]
+		if !ok {
+			meta, ok = m[path.Base(images[i].Name)]
+		}
+		if ok {
+			images[i].Focus = meta.Focus
+			images[i].Tags = normalizeTags(append(images[i].Tags, meta.Tags...))
+		}
+	}
+}
+
+// dirTags tags an original with the directories it sits in, so that
+// chicks/original-1.jpg is tagged chicks.
+func dirTags(name string) []string {
+	dir := path.Dir(name)
+	if dir == "." || dir == "/" {
+		return nil
+	}
+	return normalizeTags(strings.Split(strings.Trim(dir, "/"), "/"))
+}
+
+// normalizeTags lower cases, sorts and de-duplicates tags.
+func normalizeTags(tags []string) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			out = append(out, tag)
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	sort.Strings(out)
+	return out
+}
+
+// focusRect returns the largest window of b with the aspect ratio of w by h,
+// centered as closely as possible on the focal point.
+func focusRect(b image.Rectangle, w int, h int, f Focus) image.Rectangle {
+	cropW, cropH := cropSize(b, w, h)
+	x := b.Min.X + int(math.Round(f.X*float64(b.Dx())-float64(cropW)/2))
+	y := b.Min.Y + int(math.Round(f.Y*float64(b.Dy())-float64(cropH)/2))
+	x = clamp(x, b.Min.X, b.Max.X-cropW)
+	y = clamp(y, b.Min.Y, b.Max.Y-cropH)
+	return image.Rect(x, y, x+cropW, y+cropH)
+}
+
+// cropSize returns the size of the largest window of b with the aspect ratio
+// of w by h.
+func cropSize(b image.Rectangle, w int, h int) (int, int) {
+	cropW, cropH := b.Dx(), b.Dy()
+	if cropW*h > cropH*w {
+		cropW = int(math.Round(float64(cropH) * float64(w) / float64(h)))
+	} else {
+		cropH = int(math.Round(float64(cropW) * float64(h) / float64(w)))
+	}
+	// extreme ratios would otherwise round the crop away entirely
+	if cropW < 1 {
+		cropW = 1
+	}
+	if cropH < 1 {
+		cropH = 1
+	}
+	return cropW, cropH
+}
+
+func clamp(n int, min int, max int) int {
+	if n > max {
+		n = max
+	}
+	if n < min {
+		n = min
+	}
+	return n
+}
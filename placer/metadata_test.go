@@ -0,0 +1,83 @@
+package placer
+
+import (
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadMetadata(t *testing.T) {
+	m, err := readMetadata(strings.NewReader(`{"original-a.jpg": {"focus": {"x": 0.25, "y": 0.75}}, "original-b.jpg": {"tags": ["Rooster"]}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, &Focus{X: 0.25, Y: 0.75}, m["original-a.jpg"].Focus)
+	assert.Nil(t, m["original-b.jpg"].Focus)
+
+	images := []Image{{Name: "original-a.jpg"}, {Name: "barn/original-b.jpg", Tags: []string{"barn"}}}
+	applyMetadata(images, m)
+	assert.Equal(t, &Focus{X: 0.25, Y: 0.75}, images[0].Focus)
+	assert.Nil(t, images[0].Tags)
+	assert.Equal(t, []string{"barn", "rooster"}, images[1].Tags, "sidecar tags add to directory tags")
+
+	_, err = readMetadata(strings.NewReader(`{"original-a.jpg": {"focus": {"x": 1.5, "y": 0}}}`))
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "focus for original-a.jpg must be between 0 and 1")
+	}
+	_, err = readMetadata(strings.NewReader(`[]`))
+	assert.NotNil(t, err)
+}
+
+func TestLibraryMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "placechicken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"original-a.jpg", "original-b.jpg"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("chicken"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := Dir{}
+	l, err := d.Library(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, l.Images()[0].Focus, "no sidecar means no metadata")
+
+	sidecar := filepath.Join(dir, MetadataFile)
+	if err := ioutil.WriteFile(sidecar, []byte(`{"original-b.jpg": {"focus": {"x": 0.1, "y": 0.2}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, l.Reload())
+	images := l.Images()
+	assert.Equal(t, 2, len(images), "the sidecar isn't an image")
+	assert.Nil(t, images[0].Focus)
+	assert.Equal(t, &Focus{X: 0.1, Y: 0.2}, images[1].Focus)
+
+	if err := ioutil.WriteFile(sidecar, []byte(`{"original-b.jpg": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, l.Reload(), "a malformed sidecar should be reported")
+	assert.Equal(t, images, l.Images(), "a failed reload keeps the old index")
+}
+
+func TestFocusRect(t *testing.T) {
+	b := image.Rect(0, 0, 400, 200)
+	tt := []struct {
+		focus    Focus
+		expected image.Rectangle
+	}{
+		{focus: Focus{X: 0.5, Y: 0.5}, expected: image.Rect(150, 0, 250, 200)},
+		{focus: Focus{X: 0.25, Y: 0.5}, expected: image.Rect(50, 0, 150, 200)},
+		// pushed back inside the original at the edges
+		{focus: Focus{X: 0, Y: 0}, expected: image.Rect(0, 0, 100, 200)},
+		{focus: Focus{X: 1, Y: 1}, expected: image.Rect(300, 0, 400, 200)},
+	}
+	for _, table := range tt {
+		assert.Equal(t, table.expected, focusRect(b, 100, 200, table.focus), "%+v", table.focus)
+	}
+}
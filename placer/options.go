@@ -0,0 +1,241 @@
+package placer
+
+import (
+	"fmt"
+	"image/color"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/colornames"
+)
+
+// Mode is how an original is fitted to the requested dimensions.
+type Mode string
+
+const (
+	// ModeFill scales the original to cover the requested box and crops
+	// the overflow, keeping the aspect ratio. It is the default when both
+	// dimensions are given.
+	ModeFill Mode = "fill"
+	// ModeStretch scales the original to the requested box, distorting
+	// the aspect ratio if it differs.
+	ModeStretch Mode = "stretch"
+	// ModeFit scales the original to fit inside the requested box, keeping
+	// the aspect ratio, and pads the rest with the background color.
+	ModeFit Mode = "fit"
+	// ModeSmart crops to the requested aspect ratio around the original's
+	// focal point, or its most detailed part if it has none, then scales
+	// to the requested box.
+	ModeSmart Mode = "smart"
+)
+
+var modes = map[Mode]bool{
+	ModeFill:    true,
+	ModeStretch: true,
+	ModeFit:     true,
+	ModeSmart:   true,
+}
+
+// defaultBackground pads fitted renditions when no background is given.
+var defaultBackground = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+
+// anchors maps anchor names, as used in URLs, to imaging anchors.
+var anchors = map[string]imaging.Anchor{
+	"center":       imaging.Center,
+	"top":          imaging.Top,
+	"bottom":       imaging.Bottom,
+	"left":         imaging.Left,
+	"right":        imaging.Right,
+	"top-left":     imaging.TopLeft,
+	"top-right":    imaging.TopRight,
+	"bottom-left":  imaging.BottomLeft,
+	"bottom-right": imaging.BottomRight,
+}
+
+// Options describes the rendition to produce from an original.
+type Options struct {
+	// ID picks the original with that ID. Otherwise an original carrying
+	// all of Tags, and shaped as closely as possible like the requested
+	// dimensions, is picked by hashing Seed if it is set or at random.
+	ID     string
+	Seed   string
+	Tags   []string
+	Width  int
+	Height int
+	// Mode defaults to ModeFill when both dimensions are given. With only
+	// one dimension the original is always scaled to keep its aspect ratio.
+	Mode Mode
+	// Anchor is the part of the original kept by ModeFill. Left at center,
+	// the original's focal point is kept instead when it has one.
+	Anchor imaging.Anchor
+	// Background pads ModeFit renditions, white if nil.
+	Background color.Color
+	// Filters are applied once the original has been resized.
+	Filters Filters
+	// Transforms are applied last. Without Width and Height, the original
+	// is handed to them unresized.
+	Transforms Pipeline
+	// Label, if set, is drawn over the finished rendition.
+	Label *Label
+	// Watermark, if set, is composited over the finished rendition.
+	Watermark *Watermark
+}
+
+// ParseMode checks a mode name. An empty name leaves the default in place.
+func ParseMode(s string) (Mode, error) {
+	m := Mode(strings.ToLower(s))
+	if m != "" && !modes[m] {
+		return "", fmt.Errorf("unknown mode %q, expected one of %s", s, strings.Join(modeNames(), ", "))
+	}
+	return m, nil
+}
+
+// ParseAnchor returns the anchor with the given name, such as "top" or
+// "bottom-left". An empty name is the center.
+func ParseAnchor(s string) (imaging.Anchor, error) {
+	if s == "" {
+		return imaging.Center, nil
+	}
+	a, ok := anchors[strings.ToLower(s)]
+	if !ok {
+		names := []string{}
+		for name := range anchors {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return imaging.Center, fmt.Errorf("unknown anchor %q, expected one of %s", s, strings.Join(names, ", "))
+	}
+	return a, nil
+}
+
+// ParseColor returns the color for a hex value such as "ff8800", "#f80" or
+// a CSS color name such as "papayawhip".
+func ParseColor(s string) (color.Color, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	if c, ok := colornames.Map[name]; ok {
+		return c, nil
+	}
+	hex := strings.TrimPrefix(name, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		if v, err := strconv.ParseUint(hex, 16, 32); err == nil {
+			return color.NRGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 255}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid color %q, expected a hex value like ff8800 or a color name", s)
+}
+
+// mode returns the mode actually used for the options.
+func (o Options) mode() Mode {
+	if o.Width <= 0 || o.Height <= 0 {
+		return ModeStretch
+	}
+	if o.Mode == "" {
+		return ModeFill
+	}
+	return o.Mode
+}
+
+// variant returns the parts of the rendition's cache name besides its
+// dimensions, given the original's focal point, if any. Plain stretched
+// renditions keep the bare name they have always been cached under.
+func (o Options) variant(f *Focus) []string {
+	v := append(o.modeVariant(f), o.Filters.key()...)
+	if len(o.Transforms) > 0 {
+		v = append(v, "t", o.Transforms.Key())
+		if tf := o.transformFocus(f); tf != nil {
+			v = append(v, focusName(*tf))
+		}
+	}
+	if o.Label != nil {
+		v = append(v, o.Label.Key())
+	}
+	if o.Watermark != nil {
+		v = append(v, o.Watermark.Key())
+	}
+	return v
+}
+
+// size returns the dimensions originals are picked for, which come from the
+// transforms when the options have none.
+func (o Options) size() (int, int) {
+	if o.Width <= 0 && o.Height <= 0 {
+		return o.Transforms.size()
+	}
+	return o.Width, o.Height
+}
+
+func (o Options) modeVariant(f *Focus) []string {
+	switch o.mode() {
+	case ModeFill:
+		if o.focus(f) != nil {
+			return []string{string(ModeFill), focusName(*f)}
+		}
+		return []string{string(ModeFill), anchorName(o.Anchor)}
+	case ModeFit:
+		return []string{string(ModeFit), colorHex(o.background())}
+	case ModeSmart:
+		if f != nil {
+			return []string{string(ModeSmart), focusName(*f)}
+		}
+		return []string{string(ModeSmart)}
+	}
+	return nil
+}
+
+// focus returns the focal point ModeFill should keep, which is nil when the
+// original has none or the request asked for a specific anchor.
+func (o Options) focus(f *Focus) *Focus {
+	if o.Anchor != imaging.Center {
+		return nil
+	}
+	return f
+}
+
+// transformFocus returns the focal point the transforms' first step should
+// keep, which is only used when the step gets the original as is.
+func (o Options) transformFocus(f *Focus) *Focus {
+	if o.Width > 0 || o.Height > 0 {
+		return nil
+	}
+	return o.Transforms.focus(f)
+}
+
+// focusName renders a focal point as percentages, e.g. f45x20.
+func focusName(f Focus) string {
+	return fmt.Sprintf("f%.0fx%.0f", f.X*100, f.Y*100)
+}
+
+func (o Options) background() color.Color {
+	if o.Background == nil {
+		return defaultBackground
+	}
+	return o.Background
+}
+
+func colorHex(c color.Color) string {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return fmt.Sprintf("%02x%02x%02x", n.R, n.G, n.B)
+}
+
+func anchorName(a imaging.Anchor) string {
+	for name, anchor := range anchors {
+		if anchor == a {
+			return name
+		}
+	}
+	return "center"
+}
+
+func modeNames() []string {
+	names := []string{}
+	for m := range modes {
+		names = append(names, string(m))
+	}
+	sort.Strings(names)
+	return names
+}
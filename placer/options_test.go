@@ -0,0 +1,77 @@
+package placer
+
+import (
+	"image/color"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/colornames"
+)
+
+func TestParseMode(t *testing.T) {
+	m, err := ParseMode("")
+	assert.Nil(t, err)
+	assert.Equal(t, Mode(""), m)
+	m, err = ParseMode("Stretch")
+	assert.Nil(t, err)
+	assert.Equal(t, ModeStretch, m)
+	_, err = ParseMode("squash")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "fill, fit, smart, stretch")
+	}
+}
+
+func TestParseAnchor(t *testing.T) {
+	a, err := ParseAnchor("")
+	assert.Nil(t, err)
+	assert.Equal(t, imaging.Center, a)
+	a, err = ParseAnchor("bottom-left")
+	assert.Nil(t, err)
+	assert.Equal(t, imaging.BottomLeft, a)
+	_, err = ParseAnchor("middle")
+	assert.NotNil(t, err)
+}
+
+func TestOptionsVariant(t *testing.T) {
+	focus := &Focus{X: 0.45, Y: 0.2}
+	tt := []struct {
+		options  Options
+		focus    *Focus
+		expected []string
+	}{
+		{options: Options{Width: 300, Height: 200}, expected: []string{"fill", "center"}},
+		{options: Options{Width: 300, Height: 200, Anchor: imaging.Top}, expected: []string{"fill", "top"}},
+		{options: Options{Width: 300, Height: 200, Mode: ModeStretch}, expected: nil},
+		{options: Options{Width: 300, Mode: ModeFill}, expected: nil},
+		{options: Options{Width: 300, Height: 200, Mode: ModeFit}, expected: []string{"fit", "ffffff"}},
+		{options: Options{Width: 300, Height: 200, Mode: ModeFit, Background: colornames.Navy}, expected: []string{"fit", "000080"}},
+		{options: Options{Width: 300, Height: 200}, focus: focus, expected: []string{"fill", "f45x20"}},
+		{options: Options{Width: 300, Height: 200, Anchor: imaging.Top}, focus: focus, expected: []string{"fill", "top"}},
+		{options: Options{Width: 300, Height: 200, Mode: ModeSmart}, focus: focus, expected: []string{"smart", "f45x20"}},
+	}
+	for _, table := range tt {
+		assert.Equal(t, table.expected, table.options.variant(table.focus), "%+v", table.options)
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	tt := []struct {
+		value    string
+		expected color.Color
+	}{
+		{value: "ff8800", expected: color.NRGBA{R: 0xff, G: 0x88, A: 0xff}},
+		{value: "#FF8800", expected: color.NRGBA{R: 0xff, G: 0x88, A: 0xff}},
+		{value: "f80", expected: color.NRGBA{R: 0xff, G: 0x88, A: 0xff}},
+		{value: "PapayaWhip", expected: colornames.Papayawhip},
+	}
+	for _, table := range tt {
+		c, err := ParseColor(table.value)
+		assert.Nil(t, err, table.value)
+		assert.Equal(t, table.expected, c, table.value)
+	}
+	for _, value := range []string{"", "ff88", "gg8800", "chartreuse-ish"} {
+		_, err := ParseColor(value)
+		assert.NotNil(t, err, value)
+	}
+}
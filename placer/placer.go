@@ -1,9 +1,18 @@
 package placer
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
+	"hash/fnv"
 	"image"
+	"image/color"
+	"io"
+	"path"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/disintegration/imaging"
 )
@@ -13,17 +22,75 @@ type Place struct {
 	Dir              Directory
 	OriginalFilePath string
 	ResizedFilePath  string
+	Cache            *DiskCache
+	Memory           *MemCache
+	// Watermarks are the overlays requests may ask for by name.
+	Watermarks map[string]image.Image
+	// Watermark, if set, is composited over every rendition, on top of
+	// any the request asked for.
+	Watermark *Watermark
+	// Fallback, if set, is generated in place of an original when none can
+	// be read.
+	Fallback *Fallback
 }
 
-// Image ...
+// Rendition is a resized image encoded and ready to be served.
+type Rendition struct {
+	Source Image
+	Data   []byte
+	// Upscaled is set when the original had to be scaled up, because no
+	// original large enough was available.
+	Upscaled bool
+	// Fallback is why the rendition was generated from the place's
+	// Fallback, such as FallbackEmpty, or empty for an original.
+	Fallback string
+}
+
+// Image describes an original in a library.
 type Image struct {
-	Name string
+	// ID identifies the original in URLs. It is set when the library is
+	// indexed.
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified"`
+	// ETag is the origin's validator for backends that have one in place
+	// of a size and modification time, such as an HTTP ETag.
+	ETag string `json:"etag,omitempty"`
+	// Width and Height are read from the original's header when the
+	// library is indexed, and are zero if it couldn't be read.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// Focus is set from the library's MetadataFile.
+	Focus *Focus `json:"focus,omitempty"`
+	// Tags come from the directories the original sits in and the
+	// library's MetadataFile, lower cased and sorted.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// version tells revisions of an original apart in cache keys, so a replaced
+// original isn't served from renditions of the old one. It is "" if the
+// backend reports neither an ETag nor a size or modification time.
+func (i Image) version() string {
+	if i.ETag == "" && i.Size == 0 && i.ModTime.IsZero() {
+		return ""
+	}
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s-%d-%d", i.ETag, i.Size, i.ModTime.UnixNano())
+	return fmt.Sprintf("v%08x", h.Sum32())
+}
+
+// covers reports whether the original is known to be at least w by h. A
+// dimension of zero isn't requested.
+func (i Image) covers(w int, h int) bool {
+	return i.Width >= w && i.Height >= h
 }
 
-// Directory provides a function for listing files in a local or
-// remote directory.
+// Directory provides functions for indexing and reading files in a
+// local or remote directory.
 type Directory interface {
-	RandImg(string) (Image, error)
+	Library(string) (*Library, error)
+	Open(string, Image) (io.ReadCloser, error)
 }
 
 // Config returns a Place configuration with file settings
@@ -38,26 +105,210 @@ func Config(dir Directory, oPath string, rPath string) Place {
 // GetImage takes a width and height and returns an image sized to the
 // dimensions specified.
 func (p *Place) GetImage(w int, h int) (image.Image, error) {
-	// get a random image from the images dir
-	srcImg, err := p.Dir.RandImg(p.OriginalFilePath)
+	r, err := p.Render(Options{Width: w, Height: h})
 	if err != nil {
 		return nil, err
 	}
+	return imaging.Decode(bytes.NewReader(r.Data))
+}
+
+// Render returns an image, chosen as the options specify or at random, sized
+// as the options specify and encoded as a jpeg, served from the caches where
+// possible.
+func (p *Place) Render(o Options) (Rendition, error) {
+	srcImg, err := p.Pick(o)
+	if err != nil {
+		return p.fallbackOr(Rendition{}, o, err)
+	}
+	r := Rendition{
+		Source:   srcImg,
+		Upscaled: srcImg.Width > 0 && !srcImg.covers(o.size()),
+	}
+
+	variant := o.variant(srcImg.Focus)
+	if p.Watermark != nil {
+		variant = append(variant, p.Watermark.Key())
+	}
+	if v := srcImg.version(); v != "" {
+		variant = append(variant, v)
+	}
+	name := p.newFileName(srcImg.Name, o.Width, o.Height, variant...)
+	if data, ok := p.cached(name); ok {
+		r.Data = data
+		return r, nil
+	}
 
-	src, err := imaging.Open(p.OriginalFilePath + srcImg.Name)
+	src, err := p.source(srcImg)
 	if err != nil {
+		return p.fallbackOr(r, o, err)
+	}
+	r.Data, err = p.encode(src, o, srcImg.Focus)
+	if err != nil {
+		return r, err
+	}
+	p.store(name, r.Data)
+	return r, nil
+}
+
+// encode resizes, filters, transforms and overlays src as the options
+// specify, and encodes the result as a jpeg.
+func (p *Place) encode(src image.Image, o Options, f *Focus) ([]byte, error) {
+	resized := o.Transforms.apply(o.Filters.Apply(resize(src, o, f)), o.transformFocus(f))
+	if o.Label != nil {
+		resized = o.Label.Apply(resized)
+	}
+	if o.Watermark != nil {
+		resized = o.Watermark.Apply(resized)
+	}
+	if p.Watermark != nil {
+		resized = p.Watermark.Apply(resized)
+	}
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, resized, imaging.JPEG); err != nil {
 		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	//	name := p.newFileName(srcImg.Name, w, h)
-	resized := imaging.Resize(src, w, h, imaging.Lanczos)
-	return resized, nil
+// fallbackOr generates a fallback for the options when no original could be
+// read because of err, and the place has one. Otherwise it returns r and err.
+func (p *Place) fallbackOr(r Rendition, o Options, err error) (Rendition, error) {
+	if p.Fallback == nil {
+		return r, err
+	}
+	reason := fallbackReason(o, err)
+	if reason == "" {
+		return r, err
+	}
+	return p.fallback(o, reason)
 }
 
-func (p *Place) newFileName(name string, w int, h int) string {
-	idx := strings.Index(name, ".jpg")
-	if idx > -1 {
-		return fmt.Sprintf("%s%s-%dx%d%s", p.ResizedFilePath, name[:idx], w, h, name[idx:])
+// Pick chooses the original for a rendition.
+func (p *Place) Pick(o Options) (Image, error) {
+	lib, err := p.Dir.Library(p.OriginalFilePath)
+	if err != nil {
+		return Image{}, err
 	}
-	return name
+	if o.ID != "" {
+		return lib.Get(o.ID)
+	}
+	return lib.Select(o)
 }
+
+// resize fits an original, with focal point f if it has one, to the options'
+// dimensions.
+func resize(src image.Image, o Options, f *Focus) image.Image {
+	if o.Width <= 0 && o.Height <= 0 {
+		return src
+	}
+	switch o.mode() {
+	case ModeFill:
+		if f := o.focus(f); f != nil {
+			crop := imaging.Crop(src, focusRect(src.Bounds(), o.Width, o.Height, *f))
+			return imaging.Resize(crop, o.Width, o.Height, imaging.Lanczos)
+		}
+		return imaging.Fill(src, o.Width, o.Height, o.Anchor, imaging.Lanczos)
+	case ModeFit:
+		return fit(src, o.Width, o.Height, o.background())
+	case ModeSmart:
+		return smartCrop(src, o.Width, o.Height, f)
+	}
+	return imaging.Resize(src, o.Width, o.Height, imaging.Lanczos)
+}
+
+// fit scales src up or down to fit inside w by h and centers it on a
+// background of exactly that size.
+func fit(src image.Image, w int, h int, bg color.Color) image.Image {
+	b := src.Bounds()
+	var scaled image.Image
+	if b.Dx()*h > b.Dy()*w {
+		scaled = imaging.Resize(src, w, 0, imaging.Lanczos)
+	} else {
+		scaled = imaging.Resize(src, 0, h, imaging.Lanczos)
+	}
+	return imaging.PasteCenter(imaging.New(w, h, bg), scaled)
+}
+
+// source returns the decoded original for an image, streamed from the
+// directory. Originals are kept in memory under their library path as well
+// as their name, as places may share a MemCache, and their version.
+func (p *Place) source(i Image) (image.Image, error) {
+	key := p.OriginalFilePath + "\x00" + i.Name + "\x00" + i.version()
+	if p.Memory != nil {
+		if src, ok := p.Memory.Source(key); ok {
+			return src, nil
+		}
+	}
+	rc, err := p.Dir.Open(p.OriginalFilePath, i)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	src, err := imaging.Decode(rc)
+	if err != nil {
+		return nil, err
+	}
+	if p.Memory != nil {
+		p.Memory.AddSource(key, src)
+	}
+	return src, nil
+}
+
+// cached looks a rendition up in memory, then on disk.
+func (p *Place) cached(name string) ([]byte, bool) {
+	if p.Memory != nil {
+		if data, ok := p.Memory.Rendition(name); ok {
+			return data, true
+		}
+	}
+	if p.Cache != nil {
+		if data, ok := p.Cache.Get(name); ok {
+			if p.Memory != nil {
+				p.Memory.AddRendition(name, data)
+			}
+			return data, true
+		}
+	}
+	return nil, false
+}
+
+// store saves a freshly encoded rendition to the caches. A failed disk write
+// only costs a resize next time around, so it doesn't fail the request.
+func (p *Place) store(name string, data []byte) {
+	if p.Memory != nil {
+		p.Memory.AddRendition(name, data)
+	}
+	if p.Cache != nil {
+		p.Cache.Put(name, data)
+	}
+}
+
+// newFileName returns where a rendition of name is cached, with any variant
+// parts appended after the dimensions. Renditions are always jpegs, so an
+// original's extension other than .jpg is kept as part of the name, telling
+// chicken.png and chicken.jpg apart. Names from backends with nested keys or
+// URLs are flattened into a single file name.
+func (p *Place) newFileName(name string, w int, h int, variant ...string) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if ext != "" && ext != ".jpg" {
+		base += "_" + strings.TrimPrefix(ext, ".")
+	}
+	flat := fileNameReplacer.Replace(base)
+	suffix := ""
+	if len(variant) > 0 {
+		suffix = "-" + strings.Join(variant, "-")
+	}
+	if len(suffix) > maxSuffix {
+		// too long for a file name, a hash still tells variants apart
+		sum := sha1.Sum([]byte(suffix))
+		suffix = "-" + hex.EncodeToString(sum[:10])
+	}
+	return filepath.Join(p.ResizedFilePath, fmt.Sprintf("%s-%dx%d%s.jpg", flat, w, h, suffix))
+}
+
+// maxSuffix bounds the variant part of a cached rendition's name, keeping
+// file names well inside the usual 255 byte limit.
+const maxSuffix = 120
+
+var fileNameReplacer = strings.NewReplacer("/", "_", "\\", "_", ":", "_", "?", "_", "*", "_")
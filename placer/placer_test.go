@@ -1,12 +1,21 @@
 package placer
 
 import (
+	"bytes"
 	"fmt"
 	"image"
+	"image/color"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/disintegration/imaging"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/image/colornames"
 )
 
 func TestImageResizer(t *testing.T) {
@@ -55,7 +64,14 @@ func TestImageResizer(t *testing.T) {
 		file := Image{Name: fileInfo.Name()}
 		fileList = append(fileList, file)
 		td.On("list", "../static/images/test/").Return(fileList, table.expectedErr)
-		td.On("RandImg", "../static/images/test/").Return(file, table.expectedErr)
+		lib := MockLibrary("../static/images/test/", file)
+		file = lib.Images()[0]
+		td.On("Library", "../static/images/test/").Return(lib, table.expectedErr)
+		f, err := os.Open(table.path + table.fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		td.On("Open", "../static/images/test/", file).Return(f, nil)
 		image, err := place.GetImage(table.width, table.height)
 		if err != nil {
 			t.Fatal(err)
@@ -88,7 +104,28 @@ func TestNewFileName(t *testing.T) {
 			path:     "",
 			width:    400,
 			height:   800,
-			expected: "test-image",
+			expected: "test-image-400x800.jpg",
+		},
+		{
+			name:     "test-image.png",
+			path:     "/testpath",
+			width:    400,
+			height:   800,
+			expected: "/testpath/test-image_png-400x800.jpg",
+		},
+		{
+			name:     "test-image.JPG",
+			path:     "/testpath",
+			width:    400,
+			height:   800,
+			expected: "/testpath/test-image_JPG-400x800.jpg",
+		},
+		{
+			name:     "http://chickens/images/test-image.jpg",
+			path:     "/testpath",
+			width:    400,
+			height:   800,
+			expected: "/testpath/http___chickens_images_test-image-400x800.jpg",
 		},
 	}
 
@@ -100,4 +137,272 @@ func TestNewFileName(t *testing.T) {
 		name := p.newFileName(table.name, table.width, table.height)
 		assert.Equal(t, table.expected, name)
 	}
+	p := Place{ResizedFilePath: "/testpath"}
+	long := []string{"t", strings.Repeat("blur,2+", 30)}
+	name := p.newFileName("test-image.jpg", 0, 0, long...)
+	assert.True(t, len(filepath.Base(name)) < 100, "long variants should be hashed")
+	assert.NotEqual(t, name, p.newFileName("test-image.jpg", 0, 0, "t", strings.Repeat("blur,3+", 30)))
+}
+
+func TestImageResizerCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "placechicken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := NewDiskCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	td := MockDir{}
+	place := Place{
+		Dir:              &td,
+		OriginalFilePath: "../static/images/test/",
+		ResizedFilePath:  dir + "/",
+		Cache:            cache,
+	}
+	file := Image{Name: "original-test-image.jpg"}
+	lib := MockLibrary("../static/images/test/", file)
+	file = lib.Images()[0]
+	td.On("Library", "../static/images/test/").Return(lib, nil)
+	f, err := os.Open("../static/images/test/original-test-image.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	td.On("Open", "../static/images/test/", file).Return(f, nil).Once()
+
+	img, err := place.GetImage(300, 200)
+	assert.Nil(t, err)
+	assert.Equal(t, image.Point{X: 300, Y: 200}, img.Bounds().Size())
+
+	name := place.newFileName(file.Name, 300, 200, Options{Width: 300, Height: 200}.variant(nil)...)
+	_, ok := cache.Get(name)
+	assert.True(t, ok, "rendition should be written to the cache")
+
+	img, err = place.GetImage(300, 200)
+	assert.Nil(t, err)
+	assert.Equal(t, image.Point{X: 300, Y: 200}, img.Bounds().Size())
+}
+
+func TestRenderMemoryCache(t *testing.T) {
+	td := MockDir{}
+	mem := NewMemCache(64<<20, 8<<20)
+	place := Place{
+		Dir:              &td,
+		OriginalFilePath: "../static/images/test/",
+		Memory:           mem,
+	}
+	file := Image{Name: "original-test-image.jpg"}
+	lib := MockLibrary("../static/images/test/", file)
+	file = lib.Images()[0]
+	td.On("Library", "../static/images/test/").Return(lib, nil)
+	f, err := os.Open("../static/images/test/original-test-image.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	td.On("Open", "../static/images/test/", file).Return(f, nil).Once()
+
+	first, err := place.Render(Options{Width: 300, Height: 200})
+	assert.Nil(t, err)
+	assert.Equal(t, file, first.Source)
+	second, err := place.Render(Options{Width: 300, Height: 200})
+	assert.Nil(t, err)
+	assert.Equal(t, first.Data, second.Data)
+
+	_, err = place.Render(Options{Width: 200, Height: 300})
+	assert.Nil(t, err)
+	assert.Equal(t, CacheStats{
+		SourceHits:      1,
+		SourceMisses:    1,
+		RenditionHits:   1,
+		RenditionMisses: 2,
+	}, mem.Stats())
+}
+
+func TestRenderCachesAnyOriginal(t *testing.T) {
+	for _, name := range []string{"original-a.png", "original-b.JPG", "original-c"} {
+		td := MockDir{}
+		mem := NewMemCache(64<<20, 8<<20)
+		place := Place{
+			Dir:              &td,
+			OriginalFilePath: "../static/images/test/",
+			Memory:           mem,
+		}
+		lib := MockLibrary("../static/images/test/", Image{Name: name})
+		td.On("Library", "../static/images/test/").Return(lib, nil)
+		td.On("Open", "../static/images/test/", lib.Images()[0]).Return(MockOpen("../static/images/test/original-test-image.jpg"), nil)
+		for i := 0; i < 2; i++ {
+			_, err := place.Render(Options{Width: 300, Height: 200})
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, uint64(1), mem.Stats().RenditionHits, "%s renditions should be cached", name)
+	}
+}
+
+func TestRenderOriginalReplaced(t *testing.T) {
+	td := MockDir{}
+	mem := NewMemCache(64<<20, 8<<20)
+	place := Place{
+		Dir:              &td,
+		OriginalFilePath: "../static/images/test/",
+		Memory:           mem,
+	}
+	modified := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	lib := NewLibrary("../static/images/test/", func(string) ([]Image, error) {
+		return []Image{{Name: "original-test-image.jpg", Size: 100, ModTime: modified}}, nil
+	})
+	assert.Nil(t, lib.Reload())
+	td.On("Library", "../static/images/test/").Return(lib, nil)
+	td.On("Open", "../static/images/test/", mock.Anything).Return(MockOpen("../static/images/test/original-test-image.jpg"), nil)
+
+	_, err := place.Render(Options{Width: 300, Height: 200})
+	assert.Nil(t, err)
+	_, err = place.Render(Options{Width: 300, Height: 200})
+	assert.Nil(t, err)
+	modified = modified.Add(time.Hour)
+	assert.Nil(t, lib.Reload())
+	_, err = place.Render(Options{Width: 300, Height: 200})
+	assert.Nil(t, err)
+	assert.Equal(t, CacheStats{
+		SourceMisses:    2,
+		RenditionHits:   1,
+		RenditionMisses: 2,
+	}, mem.Stats(), "a replaced original shouldn't be served from the old one's caches")
+}
+
+func TestRenderModes(t *testing.T) {
+	td := MockDir{}
+	place := Place{
+		Dir:              &td,
+		OriginalFilePath: "../static/images/test/",
+	}
+	file := Image{Name: "original-test-image.jpg"}
+	lib := MockLibrary("../static/images/test/", file)
+	file = lib.Images()[0]
+	td.On("Library", "../static/images/test/").Return(lib, nil)
+	td.On("Open", "../static/images/test/", file).Return(MockOpen("../static/images/test/original-test-image.jpg"), nil)
+
+	tt := []struct {
+		name     string
+		options  Options
+		expected image.Point
+	}{
+		{
+			name:     "fill is the default for two dimensions",
+			options:  Options{Width: 300, Height: 500},
+			expected: image.Point{X: 300, Y: 500},
+		},
+		{
+			name:     "fill anchored at the left",
+			options:  Options{Width: 300, Height: 500, Mode: ModeFill, Anchor: imaging.Left},
+			expected: image.Point{X: 300, Y: 500},
+		},
+		{
+			name:     "stretch",
+			options:  Options{Width: 300, Height: 500, Mode: ModeStretch},
+			expected: image.Point{X: 300, Y: 500},
+		},
+	}
+	renditions := map[string]bool{}
+	for _, table := range tt {
+		r, err := place.Render(table.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := imaging.Decode(bytes.NewReader(r.Data))
+		assert.Nil(t, err, table.name)
+		assert.Equal(t, table.expected, img.Bounds().Size(), table.name)
+		renditions[string(r.Data)] = true
+	}
+	assert.Equal(t, len(tt), len(renditions), "each mode should crop differently")
+
+	// fitting a landscape original into a portrait box pads above and below
+	r, err := place.Render(Options{Width: 300, Height: 500, Mode: ModeFit, Background: colornames.Red})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fitted, err := imaging.Decode(bytes.NewReader(r.Data))
+	assert.Nil(t, err)
+	assert.Equal(t, image.Point{X: 300, Y: 500}, fitted.Bounds().Size())
+	c := color.NRGBAModel.Convert(fitted.At(150, 5)).(color.NRGBA)
+	assert.True(t, c.R > 0xf0 && c.G < 0x10, "padding should be the background color")
+
+	// with a single dimension the aspect ratio is kept whatever the mode
+	r, err = place.Render(Options{Width: 300, Mode: ModeFill})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := imaging.Decode(bytes.NewReader(r.Data))
+	assert.Nil(t, err)
+	assert.Equal(t, 300, img.Bounds().Dx())
+	assert.NotEqual(t, 0, img.Bounds().Dy())
+}
+
+func TestRenderUpscaled(t *testing.T) {
+	td := MockDir{}
+	place := Place{
+		Dir:              &td,
+		OriginalFilePath: "../static/images/test/",
+	}
+	lib := MockLibrary("../static/images/test/", Image{Name: "original-test-image.jpg", Width: 2160, Height: 1440})
+	file := lib.Images()[0]
+	td.On("Library", "../static/images/test/").Return(lib, nil)
+	td.On("Open", "../static/images/test/", file).Return(MockOpen("../static/images/test/original-test-image.jpg"), nil)
+
+	r, err := place.Render(Options{Width: 300, Height: 200})
+	assert.Nil(t, err)
+	assert.False(t, r.Upscaled)
+	r, err = place.Render(Options{Width: 3000, Height: 200})
+	assert.Nil(t, err)
+	assert.True(t, r.Upscaled)
+}
+
+func TestRenderTransforms(t *testing.T) {
+	td := MockDir{}
+	place := Place{
+		Dir:              &td,
+		OriginalFilePath: "../static/images/test/",
+	}
+	lib := MockLibrary("../static/images/test/", Image{Name: "original-test-image.jpg"})
+	td.On("Library", "../static/images/test/").Return(lib, nil)
+	td.On("Open", "../static/images/test/", lib.Images()[0]).Return(MockOpen("../static/images/test/original-test-image.jpg"), nil)
+
+	p, err := ParsePipeline([]string{"fill,300,200", "rotate,90"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := place.Render(Options{Transforms: p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := imaging.Decode(bytes.NewReader(r.Data))
+	assert.Nil(t, err)
+	assert.Equal(t, image.Point{X: 200, Y: 300}, img.Bounds().Size())
+}
+
+func TestRenderWatermark(t *testing.T) {
+	td := MockDir{}
+	mem := NewMemCache(64<<20, 8<<20)
+	place := Place{
+		Dir:              &td,
+		OriginalFilePath: "../static/images/test/",
+		Memory:           mem,
+	}
+	lib := MockLibrary("../static/images/test/", Image{Name: "original-test-image.jpg"})
+	td.On("Library", "../static/images/test/").Return(lib, nil)
+	td.On("Open", "../static/images/test/", lib.Images()[0]).Return(MockOpen("../static/images/test/original-test-image.jpg"), nil)
+
+	plain, err := place.Render(Options{Width: 300, Height: 200})
+	assert.Nil(t, err)
+	// a collection's watermark is part of the rendition's cache name, so
+	// renditions cached without it aren't served
+	place.Watermark = &Watermark{Name: "logo", Image: imaging.New(40, 20, color.White), Opacity: 1, Position: imaging.BottomRight}
+	marked, err := place.Render(Options{Width: 300, Height: 200})
+	assert.Nil(t, err)
+	assert.NotEqual(t, plain.Data, marked.Data)
+	img, err := imaging.Decode(bytes.NewReader(marked.Data))
+	assert.Nil(t, err)
+	c := color.NRGBAModel.Convert(img.At(290, 190)).(color.NRGBA)
+	assert.True(t, c.R > 0xf0 && c.G > 0xf0 && c.B > 0xf0, "the watermark should be drawn, got %v", c)
 }
@@ -2,85 +2,183 @@ package placer
 
 import (
 	"fmt"
-	"math/rand"
+	"io"
 	"os"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
 
 // S3 struct exists as a placeholder to allow abstracting aws' s3 methods.
+// Paths handed to it are either a bare bucket name or a bucket and key
+// prefix such as s3://bucket/chickens/.
 type S3 struct {
 	Session *session.Session
+	// Client overrides the client built from Session, e.g. to talk to a
+	// stand-in in tests.
+	Client s3iface.S3API
+	// TTL is how long a bucket listing is served before it is refreshed in
+	// the background. Zero keeps a listing until it is reloaded.
+	TTL time.Duration
+	libraries
+}
+
+// defaultRegion is used when no region is configured.
+const defaultRegion = "us-west-2"
+
+// S3Options holds the connection settings for an S3 or S3 compatible store
+// such as MinIO or LocalStack.
+type S3Options struct {
+	Region string
+	// Endpoint overrides the AWS endpoint, e.g. http://localhost:9000.
+	Endpoint string
+	// PathStyle addresses buckets as endpoint/bucket rather than as
+	// bucket.endpoint, which most stand-ins need.
+	PathStyle bool
+	// AccessKeyID and SecretAccessKey, when set, are used instead of the
+	// default credential chain.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Profile picks a profile from the shared credentials file.
+	Profile string
+}
+
+// S3OptionsFromEnv reads S3 settings from REGION, S3_ENDPOINT,
+// S3_PATH_STYLE, S3_ACCESS_KEY_ID, S3_SECRET_ACCESS_KEY, S3_SESSION_TOKEN and
+// S3_PROFILE.
+func S3OptionsFromEnv() S3Options {
+	pathStyle, _ := strconv.ParseBool(os.Getenv("S3_PATH_STYLE"))
+	return S3Options{
+		Region:          os.Getenv("REGION"),
+		Endpoint:        os.Getenv("S3_ENDPOINT"),
+		PathStyle:       pathStyle,
+		AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("S3_SESSION_TOKEN"),
+		Profile:         os.Getenv("S3_PROFILE"),
+	}
 }
 
 // S3Config returns an s3 config populated with a session.
-func S3Config() (S3, error) {
-	session, err := session.NewSession(&aws.Config{
-		Region: aws.String("us-west-2")},
-	)
+func S3Config(o S3Options) (S3, error) {
+	region := o.Region
+	if region == "" {
+		region = defaultRegion
+	}
+	cfg := &aws.Config{
+		Region:           aws.String(region),
+		S3ForcePathStyle: aws.Bool(o.PathStyle),
+	}
+	if o.Endpoint != "" {
+		cfg.Endpoint = aws.String(o.Endpoint)
+	}
+	switch {
+	case o.AccessKeyID != "":
+		cfg.Credentials = credentials.NewStaticCredentials(o.AccessKeyID, o.SecretAccessKey, o.SessionToken)
+	case o.Profile != "":
+		cfg.Credentials = credentials.NewSharedCredentials("", o.Profile)
+	}
+
+	session, err := session.NewSession(cfg)
 	if err != nil {
 		return S3{}, err
 	}
 	return S3{Session: session}, err
 }
 
-// RandImg gets a list of objects in s3, and returns a random object for image
-// manipulation.
-func (s *S3) RandImg(b string) (Image, error) {
-	var fileName string
-	objects, err := s.list(b)
-	i := Image{}
+// Library returns the index of objects in a bucket, building it on first use.
+func (s *S3) Library(b string) (*Library, error) {
+	return s.libraries.get(b, func(b string) *Library {
+		l := NewLibrary(b, s.list)
+		l.ttl = s.TTL
+		l.open = s.Open
+		l.head = s.head
+		return l
+	})
+}
+
+// Open streams an object's contents from the bucket. Names outside the
+// path's prefix, such as the MetadataFile, are looked up under it.
+func (s *S3) Open(b string, i Image) (io.ReadCloser, error) {
+	bucket, prefix := parseS3Path(b)
+	key := i.Name
+	if !strings.HasPrefix(key, prefix) {
+		key = prefix + key
+	}
+	out, err := s.client().GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
 	if err != nil {
-		return i, err
+		return nil, err
 	}
+	return out.Body, nil
+}
 
-	if len(objects) > 0 {
-		randIdx := rand.Intn(len(objects))
-		randObject := objects[randIdx]
-		fileName, err = s.download(randObject, b)
-		if err != nil {
-			return i, err
-		}
+// head reads the first headerBytes of an object, which is enough to find the
+// dimensions of an original without downloading it.
+func (s *S3) head(b string, i Image) (io.ReadCloser, error) {
+	bucket, prefix := parseS3Path(b)
+	key := i.Name
+	if !strings.HasPrefix(key, prefix) {
+		key = prefix + key
 	}
-	i.Name = fileName
-	return i, nil
+	out, err := s.client().GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", headerBytes-1)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
 }
 
 func (s *S3) list(b string) ([]Image, error) {
 	i := []Image{}
-	svc := s3.New(s.Session)
-	resp, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(b)})
-	if err != nil {
-		return i, err
+	bucket, prefix := parseS3Path(b)
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(bucket)}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
 	}
-	for _, object := range resp.Contents {
-		if strings.Contains(*object.Key, "original") {
-			i = append(i, Image{Name: *object.Key})
+	err := s.client().ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, object := range page.Contents {
+			if strings.Contains(path.Base(*object.Key), "original") {
+				i = append(i, Image{
+					Name:    *object.Key,
+					Size:    aws.Int64Value(object.Size),
+					ModTime: aws.TimeValue(object.LastModified),
+					Tags:    dirTags(strings.TrimPrefix(*object.Key, prefix)),
+				})
+			}
 		}
-	}
+		return true
+	})
 	return i, err
 }
 
-func (s *S3) download(i Image, b string) (string, error) {
-	downloader := s3manager.NewDownloader(s.Session)
-	file, err := os.Create("/tmp/placechicken/" + i.Name)
-	if err != nil {
-		return "", err
-	}
-	numBytes, err := downloader.Download(file,
-		&s3.GetObjectInput{
-			Bucket: aws.String(b),
-			Key:    aws.String(i.Name),
-		})
-	if err != nil {
-		return "", err
+func (s *S3) client() s3iface.S3API {
+	if s.Client != nil {
+		return s.Client
 	}
+	return s3.New(s.Session)
+}
 
-	fmt.Printf("object %s downloaded to %s file size %d", i.Name, file.Name(), numBytes)
-	return file.Name(), nil
-
+// parseS3Path splits a bucket path such as s3://bucket/chickens/ into the
+// bucket and key prefix.
+func parseS3Path(b string) (string, string) {
+	b = strings.TrimPrefix(b, "s3://")
+	idx := strings.Index(b, "/")
+	if idx < 0 {
+		return b, ""
+	}
+	return b[:idx], b[idx+1:]
 }
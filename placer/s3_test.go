@@ -1,23 +1,182 @@
 package placer
 
 import (
+	"encoding/xml"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestS3List(t *testing.T) {
-	bucket := "placechicken-test"
-	s, err := S3Config()
+// fakeS3 is an in-process stand-in for the parts of the S3 API the backend
+// uses. It serves objects from memory with path-style addressing and pages
+// listings pageSize keys at a time.
+type fakeS3 struct {
+	objects  map[string]map[string]string
+	pageSize int
+}
+
+type fakeListing struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	KeyCount              int            `xml:"KeyCount"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	Contents              []fakeS3Object `xml:"Contents"`
+}
+
+type fakeS3Object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	Size         int       `xml:"Size"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket, ok := f.objects[parts[0]]
+	if !ok || r.Method != "GET" {
+		http.Error(w, "<Error><Code>NoSuchBucket</Code></Error>", http.StatusNotFound)
+		return
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		body, ok := bucket[parts[1]]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, body)
+		return
+	}
+
+	q := r.URL.Query()
+	keys := []string{}
+	for key := range bucket {
+		if strings.HasPrefix(key, q.Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	start, _ := strconv.Atoi(q.Get("continuation-token"))
+	end := start + f.pageSize
+	out := fakeListing{Name: parts[0], Prefix: q.Get("prefix")}
+	if end < len(keys) {
+		out.IsTruncated = true
+		out.NextContinuationToken = strconv.Itoa(end)
+	} else {
+		end = len(keys)
+	}
+	for _, key := range keys[start:end] {
+		out.Contents = append(out.Contents, fakeS3Object{
+			Key:          key,
+			LastModified: time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC),
+			Size:         len(bucket[key]),
+		})
+	}
+	out.KeyCount = len(out.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(out)
+}
+
+// newFakeS3 starts a fake S3 server and returns a backend configured to use
+// it. Close the server when done.
+func newFakeS3(t *testing.T, objects map[string]map[string]string) (*httptest.Server, *S3) {
+	srv := httptest.NewServer(&fakeS3{objects: objects, pageSize: 2})
+	s, err := S3Config(S3Options{
+		Region:          "us-east-1",
+		Endpoint:        srv.URL,
+		PathStyle:       true,
+		AccessKeyID:     "placechicken",
+		SecretAccessKey: "placechicken",
+	})
 	if err != nil {
-		assert.FailNowf(t, "Error creating s3 session", err.Error())
+		srv.Close()
+		t.Fatal(err)
 	}
+	return srv, &s
+}
+
+func TestS3List(t *testing.T) {
+	bucket := "placechicken-test"
+	srv, s := newFakeS3(t, map[string]map[string]string{
+		bucket: {
+			"original-test-image.jpg": "chicken",
+			"resized-test-image.jpg":  "chicken",
+		},
+	})
+	defer srv.Close()
 	iList, err := s.list(bucket)
 	assert.Nil(t, err)
 	assert.Equal(t, len(iList), 1)
 }
 
+func TestS3FakeServer(t *testing.T) {
+	srv, s := newFakeS3(t, map[string]map[string]string{
+		"placechicken-test": {
+			"chickens/original-1.jpg": "one",
+			"chickens/original-2.jpg": "two",
+			"chickens/original-3.jpg": "three",
+			"chickens/resized-1.jpg":  "one",
+			"ducks/original-1.jpg":    "duck",
+		},
+	})
+	defer srv.Close()
+
+	iList, err := s.list("s3://placechicken-test/chickens/")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(iList), "listing should follow every page")
+	assert.Equal(t, int64(3), iList[1].Size)
+
+	rc, err := s.Open("s3://placechicken-test/chickens/", iList[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	assert.Nil(t, err)
+	assert.Equal(t, "three", string(data))
+
+	_, err = s.list("missing-bucket")
+	assert.NotNil(t, err)
+}
+
+func TestS3Options(t *testing.T) {
+	s, err := S3Config(S3Options{
+		Region:          "eu-central-1",
+		Endpoint:        "http://localhost:9000",
+		PathStyle:       true,
+		AccessKeyID:     "id",
+		SecretAccessKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "eu-central-1", *s.Session.Config.Region)
+	assert.Equal(t, "http://localhost:9000", *s.Session.Config.Endpoint)
+	assert.True(t, *s.Session.Config.S3ForcePathStyle)
+	creds, err := s.Session.Config.Credentials.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "id", creds.AccessKeyID)
+
+	s, err = S3Config(S3Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, defaultRegion, *s.Session.Config.Region)
+}
+
 func TestS3GetRandomImage(t *testing.T) {
 	tt := []struct {
 		name           string
@@ -41,10 +200,125 @@ func TestS3GetRandomImage(t *testing.T) {
 
 	for _, table := range tt {
 		d := Dir{}
-		rImage, err := d.RandImg(table.path)
+		rImage, err := randImg(&d, table.path)
 		assert.Equal(t, table.expectedResult, rImage.Name)
 		if err != nil {
 			assert.Equal(t, table.expectedError.Error(), err.Error())
 		}
 	}
 }
+
+// pagedS3 serves ListObjectsV2Pages from canned pages and GetObject with a
+// fixed body, recording the inputs. It has no metadata sidecar.
+type pagedS3 struct {
+	s3iface.S3API
+	pages [][]string
+	input *s3.ListObjectsV2Input
+	get   *s3.GetObjectInput
+	calls int
+	mu    sync.Mutex
+}
+
+func (p *pagedS3) ListObjectsV2Pages(in *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	p.input = in
+	p.calls++
+	for i, page := range p.pages {
+		out := &s3.ListObjectsV2Output{}
+		for _, key := range page {
+			out.Contents = append(out.Contents, &s3.Object{Key: aws.String(key)})
+		}
+		if !fn(out, i == len(p.pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (p *pagedS3) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	p.mu.Lock()
+	p.get = in
+	p.mu.Unlock()
+	if strings.HasSuffix(*in.Key, MetadataFile) {
+		return nil, errors.New("NoSuchKey")
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader("chicken"))}, nil
+}
+
+func TestS3Open(t *testing.T) {
+	client := &pagedS3{}
+	s := S3{Client: client}
+	rc, err := s.Open("s3://placechicken-test/chickens/", Image{Name: "chickens/original-1.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	assert.Nil(t, err)
+	assert.Equal(t, "chicken", string(data))
+	assert.Equal(t, "placechicken-test", *client.get.Bucket)
+	assert.Equal(t, "chickens/original-1.jpg", *client.get.Key)
+
+	s.Open("s3://placechicken-test/chickens/", Image{Name: MetadataFile})
+	assert.Equal(t, "chickens/metadata.json", *client.get.Key, "the sidecar lives under the prefix")
+	assert.Nil(t, client.get.Range)
+
+	s.head("s3://placechicken-test/chickens/", Image{Name: "chickens/original-1.jpg"})
+	assert.Equal(t, "bytes=0-65535", aws.StringValue(client.get.Range), "measuring only reads the header")
+}
+
+func TestS3ListPaginated(t *testing.T) {
+	client := &pagedS3{pages: [][]string{
+		{"chickens/original-1.jpg", "chickens/original-2.jpg"},
+		{"chickens/resized-2.jpg", "chickens/original-3.jpg"},
+		{"chickens/original-4.jpg"},
+	}}
+	s := S3{Client: client}
+	iList, err := s.list("s3://placechicken-test/chickens/")
+	assert.Nil(t, err)
+	assert.Equal(t, "placechicken-test", *client.input.Bucket)
+	assert.Equal(t, "chickens/", *client.input.Prefix)
+	assert.Equal(t, []Image{
+		{Name: "chickens/original-1.jpg"},
+		{Name: "chickens/original-2.jpg"},
+		{Name: "chickens/original-3.jpg"},
+		{Name: "chickens/original-4.jpg"},
+	}, iList)
+}
+
+func TestS3ListingTTL(t *testing.T) {
+	client := &pagedS3{pages: [][]string{{"original-1.jpg"}}}
+	s := S3{Client: client, TTL: 20 * time.Millisecond}
+	lib, err := s.Library("placechicken-test")
+	assert.Nil(t, err)
+	assert.Nil(t, client.input.Prefix)
+	assert.False(t, lib.Watchable(), "listings can only be refreshed by their TTL")
+	lib.Rand()
+	assert.Equal(t, 1, len(lib.Images()), "a fresh listing is served as is")
+
+	time.Sleep(30 * time.Millisecond)
+	client.pages = [][]string{{"original-1.jpg", "original-2.jpg"}}
+	// the stale listing is served while it is refreshed in the background
+	assert.Equal(t, 1, len(lib.Images()))
+	deadline := time.Now().Add(2 * time.Second)
+	for len(lib.Images()) == 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, 2, len(lib.Images()))
+}
+
+func TestParseS3Path(t *testing.T) {
+	tt := []struct {
+		path   string
+		bucket string
+		prefix string
+	}{
+		{path: "placechicken", bucket: "placechicken"},
+		{path: "s3://placechicken", bucket: "placechicken"},
+		{path: "s3://placechicken/chickens/", bucket: "placechicken", prefix: "chickens/"},
+	}
+	for _, table := range tt {
+		bucket, prefix := parseS3Path(table.path)
+		assert.Equal(t, table.bucket, bucket, table.path)
+		assert.Equal(t, table.prefix, prefix, table.path)
+	}
+}
@@ -0,0 +1,119 @@
+package placer
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// analysisSize is the longest side originals are scaled down to before they
+// are scored, which keeps smart cropping cheap on large originals.
+const analysisSize = 128
+
+// smartCrop crops src to the aspect ratio of w by h around its focal point,
+// or its most interesting region if it has none, then scales it to w by h.
+func smartCrop(src image.Image, w int, h int, f *Focus) image.Image {
+	var crop image.Rectangle
+	if f != nil {
+		crop = focusRect(src.Bounds(), w, h, *f)
+	} else {
+		crop = interestingRect(src, w, h)
+	}
+	return imaging.Resize(imaging.Crop(src, crop), w, h, imaging.Lanczos)
+}
+
+// interestingRect returns the largest window of src with the aspect ratio of
+// w by h that covers the most detail. Detail is scored by edge strength and
+// color saturation, and ties go to the window nearest the center, so the
+// result is the same every time for a given original and size.
+func interestingRect(src image.Image, w int, h int) image.Rectangle {
+	b := src.Bounds()
+	cropW, cropH := cropSize(b, w, h)
+	if cropW >= b.Dx() && cropH >= b.Dy() {
+		return b
+	}
+
+	small := imaging.Resize(src, analysisSize, 0, imaging.Box)
+	if b.Dy() > b.Dx() {
+		small = imaging.Resize(src, 0, analysisSize, imaging.Box)
+	}
+	sb := small.Bounds()
+	scale := float64(sb.Dx()) / float64(b.Dx())
+	sums := scoreSums(small)
+
+	// the window only slides along the axis that's being cropped
+	winW := int(math.Round(float64(cropW) * scale))
+	winH := int(math.Round(float64(cropH) * scale))
+	if winW > sb.Dx() {
+		winW = sb.Dx()
+	}
+	if winH > sb.Dy() {
+		winH = sb.Dy()
+	}
+	best, bestScore, bestDist := image.Point{}, -1.0, math.MaxFloat64
+	centerX, centerY := float64(sb.Dx()-winW)/2, float64(sb.Dy()-winH)/2
+	for y := 0; y+winH <= sb.Dy(); y++ {
+		for x := 0; x+winW <= sb.Dx(); x++ {
+			score := sums[y+winH][x+winW] - sums[y][x+winW] - sums[y+winH][x] + sums[y][x]
+			dist := math.Abs(float64(x)-centerX) + math.Abs(float64(y)-centerY)
+			if score > bestScore+1e-9 || (math.Abs(score-bestScore) <= 1e-9 && dist < bestDist) {
+				best, bestScore, bestDist = image.Point{X: x, Y: y}, score, dist
+			}
+		}
+	}
+
+	// map the best window back onto the original
+	x := clamp(b.Min.X+int(math.Round(float64(best.X)/scale)), b.Min.X, b.Max.X-cropW)
+	y := clamp(b.Min.Y+int(math.Round(float64(best.Y)/scale)), b.Min.Y, b.Max.Y-cropH)
+	return image.Rect(x, y, x+cropW, y+cropH)
+}
+
+// scoreSums scores each pixel of img and returns the summed-area table of the
+// scores, so any window's total is four lookups.
+func scoreSums(img *image.NRGBA) [][]float64 {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	luma := make([]float64, w*h)
+	sat := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := img.PixOffset(x, y)
+			r, g, b := float64(img.Pix[i]), float64(img.Pix[i+1]), float64(img.Pix[i+2])
+			luma[y*w+x] = 0.299*r + 0.587*g + 0.114*b
+			max := math.Max(r, math.Max(g, b))
+			min := math.Min(r, math.Min(g, b))
+			if max > 0 {
+				sat[y*w+x] = (max - min) / max
+			}
+		}
+	}
+	at := func(x, y int) float64 {
+		if x < 0 {
+			x = 0
+		} else if x >= w {
+			x = w - 1
+		}
+		if y < 0 {
+			y = 0
+		} else if y >= h {
+			y = h - 1
+		}
+		return luma[y*w+x]
+	}
+
+	sums := make([][]float64, h+1)
+	for y := range sums {
+		sums[y] = make([]float64, w+1)
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// sobel edge magnitude, scaled to roughly 0..1
+			gx := at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+			gy := at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+			edge := math.Min(math.Sqrt(gx*gx+gy*gy)/1020, 1)
+			score := edge + 0.5*sat[y*w+x]
+			sums[y+1][x+1] = score + sums[y][x+1] + sums[y+1][x] - sums[y][x]
+		}
+	}
+	return sums
+}
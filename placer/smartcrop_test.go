@@ -0,0 +1,107 @@
+package placer
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+)
+
+// busyImage returns a flat gray image with a colorful checkered patch at r.
+func busyImage(w int, h int, r image.Rectangle) image.Image {
+	img := imaging.New(w, h, color.NRGBA{R: 128, G: 128, B: 128, A: 255})
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if (x/4+y/4)%2 == 0 {
+				img.Set(x, y, color.NRGBA{R: 255, G: 40, A: 255})
+			} else {
+				img.Set(x, y, color.NRGBA{B: 255, G: 200, A: 255})
+			}
+		}
+	}
+	return img
+}
+
+func TestInterestingRect(t *testing.T) {
+	tt := []struct {
+		name   string
+		detail image.Rectangle
+		width  int
+		height int
+		w      int
+		h      int
+		// expected is where the crop should land, roughly
+		expected image.Rectangle
+	}{
+		{
+			name:     "detail on the right of a wide original",
+			detail:   image.Rect(650, 50, 750, 150),
+			width:    800,
+			height:   200,
+			w:        100,
+			h:        100,
+			expected: image.Rect(556, 0, 756, 200),
+		},
+		{
+			name:     "detail at the top of a tall original",
+			detail:   image.Rect(50, 20, 150, 120),
+			width:    200,
+			height:   800,
+			w:        200,
+			h:        200,
+			expected: image.Rect(0, 13, 200, 213),
+		},
+		{
+			name:     "flat originals crop around the center",
+			width:    800,
+			height:   200,
+			w:        100,
+			h:        100,
+			expected: image.Rect(300, 0, 500, 200),
+		},
+		{
+			name:     "matching aspect ratios keep the whole original",
+			detail:   image.Rect(0, 0, 50, 50),
+			width:    400,
+			height:   200,
+			w:        200,
+			h:        100,
+			expected: image.Rect(0, 0, 400, 200),
+		},
+	}
+	for _, table := range tt {
+		src := busyImage(table.width, table.height, table.detail)
+		r := interestingRect(src, table.w, table.h)
+		assert.Equal(t, table.expected.Size(), r.Size(), table.name)
+		assert.True(t, table.detail.In(r), "%s: %v should cover %v", table.name, r, table.detail)
+		assert.True(t, abs(r.Min.X-table.expected.Min.X) <= 8 && abs(r.Min.Y-table.expected.Min.Y) <= 8,
+			"%s: got %v, expected about %v", table.name, r, table.expected)
+	}
+}
+
+func TestSmartCropDeterministic(t *testing.T) {
+	src := busyImage(640, 480, image.Rect(10, 300, 200, 470))
+	a := smartCrop(src, 120, 300, nil)
+	b := smartCrop(src, 120, 300, nil)
+	assert.Equal(t, image.Point{X: 120, Y: 300}, a.Bounds().Size())
+	assert.Equal(t, a, b)
+}
+
+func TestSmartCropExtremeRatio(t *testing.T) {
+	src := busyImage(640, 480, image.Rect(10, 300, 200, 470))
+	for _, size := range []image.Point{{X: 1, Y: 5000}, {X: 5000, Y: 1}} {
+		r := smartCrop(src, size.X, size.Y, nil)
+		assert.Equal(t, size, r.Bounds().Size())
+		r = smartCrop(src, size.X, size.Y, &Focus{X: 0.5, Y: 0.5})
+		assert.Equal(t, size, r.Bounds().Size())
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
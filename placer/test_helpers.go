@@ -1,6 +1,9 @@
 package placer
 
 import (
+	"io"
+	"os"
+
 	"github.com/stretchr/testify/mock"
 )
 
@@ -15,8 +18,40 @@ func (t *MockDir) list(p string) ([]Image, error) {
 	return args.Get(0).([]Image), args.Error(1)
 }
 
-// RandImg is a mock random get method
-func (t *MockDir) RandImg(p string) (Image, error) {
+// Library is a mock library index method
+func (t *MockDir) Library(p string) (*Library, error) {
 	args := t.Called(p)
-	return args.Get(0).(Image), args.Error(1)
+	return args.Get(0).(*Library), args.Error(1)
+}
+
+// Open is a mock image read method. The return value may be a function, so
+// that each call gets a fresh reader.
+func (t *MockDir) Open(p string, i Image) (io.ReadCloser, error) {
+	args := t.Called(p, i)
+	if fn, ok := args.Get(0).(func(string, Image) io.ReadCloser); ok {
+		return fn(p, i), args.Error(1)
+	}
+	return args.Get(0).(io.ReadCloser), args.Error(1)
+}
+
+// MockLibrary returns an indexed library of exactly the given images, for
+// mocking Directory.Library.
+func MockLibrary(p string, images ...Image) *Library {
+	l := NewLibrary(p, func(string) ([]Image, error) {
+		return append([]Image(nil), images...), nil
+	})
+	l.Reload()
+	return l
+}
+
+// MockOpen returns a result for mocking Directory.Open that opens the file
+// at name afresh on each call, for originals that are read more than once.
+func MockOpen(name string) func(string, Image) io.ReadCloser {
+	return func(string, Image) io.ReadCloser {
+		f, err := os.Open(name)
+		if err != nil {
+			panic(err)
+		}
+		return f
+	}
 }
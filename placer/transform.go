@@ -0,0 +1,443 @@
+package placer
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+)
+
+// Transform is a step of a Pipeline.
+type Transform interface {
+	// Apply returns the transformed image.
+	Apply(image.Image) image.Image
+	// Key names the step and its arguments canonically, so that steps
+	// doing the same thing share cached renditions.
+	Key() string
+}
+
+// TransformParser builds a Transform from the arguments of a step, such as
+// ["90"] for rotate,90, checking them.
+type TransformParser func(args []string) (Transform, error)
+
+// MaxSize bounds the width and height of a rendering, and the dimensions a
+// step may produce.
+const MaxSize = 8000
+
+// maxSteps bounds the length of a pipeline.
+const maxSteps = 10
+
+var (
+	transformsMu sync.RWMutex
+	transforms   = map[string]TransformParser{
+		"resize":     parseResize,
+		"fill":       parseFill,
+		"fit":        parseFit,
+		"crop":       parseCrop,
+		"rotate":     parseRotate,
+		"flip":       parseFlip,
+		"blur":       parseSigma("blur", imaging.Blur),
+		"sharpen":    parseSigma("sharpen", imaging.Sharpen),
+		"invert":     parseFixed("invert", imaging.Invert),
+		"convolve":   parseConvolve,
+		"grayscale":  parseFilterFlag("grayscale"),
+		"sepia":      parseFilterFlag("sepia"),
+		"saturation": parseFilterLevel("saturation"),
+		"brightness": parseFilterLevel("brightness"),
+		"contrast":   parseFilterLevel("contrast"),
+		"gamma":      parseFilterLevel("gamma"),
+	}
+)
+
+// RegisterTransform makes a step available to ParsePipeline under name,
+// replacing any step already registered with it.
+func RegisterTransform(name string, parse TransformParser) {
+	transformsMu.Lock()
+	defer transformsMu.Unlock()
+	transforms[name] = parse
+}
+
+// Pipeline is an ordered list of transforms, applied once the original has
+// been resized and filtered.
+type Pipeline []Transform
+
+// ParsePipeline builds a pipeline from steps written as a name followed by
+// comma separated arguments, such as fill,300,200 or rotate,90. The first
+// step must be resize, fill or fit, so the other steps never work on a full
+// size original, and there may be at most maxSteps.
+func ParsePipeline(steps []string) (Pipeline, error) {
+	p := Pipeline{}
+	for _, s := range steps {
+		if s == "" {
+			continue
+		}
+		if len(p) == maxSteps {
+			return nil, fmt.Errorf("too many steps, expected at most %d", maxSteps)
+		}
+		parts := strings.Split(s, ",")
+		transformsMu.RLock()
+		parse, ok := transforms[parts[0]]
+		names := []string{}
+		for name := range transforms {
+			names = append(names, name)
+		}
+		transformsMu.RUnlock()
+		if !ok {
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown step %q, expected one of %s", parts[0], strings.Join(names, ", "))
+		}
+		t, err := parse(parts[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s step %q: %s", parts[0], s, err)
+		}
+		if _, ok := t.(sizeStep); !ok && len(p) == 0 {
+			return nil, fmt.Errorf("the first step must be resize, fill or fit, not %q", s)
+		}
+		p = append(p, t)
+	}
+	return p, nil
+}
+
+// Apply runs each step in turn.
+func (p Pipeline) Apply(img image.Image) image.Image {
+	return p.apply(img, nil)
+}
+
+// apply runs each step in turn, with the first one keeping focal point f if
+// it can.
+func (p Pipeline) apply(img image.Image, f *Focus) image.Image {
+	for i, t := range p {
+		if s, ok := t.(sizeStep); ok && i == 0 && f != nil && s.focused != nil {
+			img = s.focused(img, *f)
+			continue
+		}
+		img = t.Apply(img)
+	}
+	return img
+}
+
+// focus returns the focal point the pipeline's first step keeps, which is
+// nil unless it is a fill without a specific anchor.
+func (p Pipeline) focus(f *Focus) *Focus {
+	if len(p) == 0 || f == nil {
+		return nil
+	}
+	if s, ok := p[0].(sizeStep); ok && s.focused != nil {
+		return f
+	}
+	return nil
+}
+
+// Key joins the keys of the steps.
+func (p Pipeline) Key() string {
+	keys := make([]string, len(p))
+	for i, t := range p {
+		keys[i] = t.Key()
+	}
+	return strings.Join(keys, "+")
+}
+
+// size returns the dimensions of the pipeline's first resizing step, which
+// is what originals are picked for when a request gives no dimensions.
+func (p Pipeline) size() (int, int) {
+	for _, t := range p {
+		if s, ok := t.(sizeStep); ok {
+			return s.w, s.h
+		}
+	}
+	return 0, 0
+}
+
+// step is a built in Transform.
+type step struct {
+	key   string
+	apply func(image.Image) image.Image
+}
+
+func (s step) Apply(img image.Image) image.Image { return s.apply(img) }
+func (s step) Key() string                       { return s.key }
+
+// sizeStep is a step that scales to w by h.
+type sizeStep struct {
+	step
+	w, h int
+	// focused, if set, scales keeping a focal point instead.
+	focused func(image.Image, Focus) image.Image
+}
+
+func parseResize(args []string) (Transform, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("expected a width and height")
+	}
+	w, err := parseInt(args[0], 0, MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	h, err := parseInt(args[1], 0, MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	if w == 0 && h == 0 {
+		return nil, fmt.Errorf("width and height can't both be 0")
+	}
+	return sizeStep{
+		step: step{
+			key: fmt.Sprintf("resize,%d,%d", w, h),
+			apply: func(img image.Image) image.Image {
+				return imaging.Resize(img, w, h, imaging.Lanczos)
+			},
+		},
+		w: w,
+		h: h,
+	}, nil
+}
+
+func parseFill(args []string) (Transform, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, fmt.Errorf("expected a width, height and optional anchor")
+	}
+	w, h, err := parseSize(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	anchor := imaging.Center
+	if len(args) == 3 {
+		if anchor, err = ParseAnchor(args[2]); err != nil {
+			return nil, err
+		}
+	}
+	s := sizeStep{
+		step: step{
+			key: fmt.Sprintf("fill,%d,%d,%s", w, h, anchorName(anchor)),
+			apply: func(img image.Image) image.Image {
+				return imaging.Fill(img, w, h, anchor, imaging.Lanczos)
+			},
+		},
+		w: w,
+		h: h,
+	}
+	if anchor == imaging.Center {
+		// as with ?mode=fill, a specific anchor wins over the focal point
+		s.focused = func(img image.Image, f Focus) image.Image {
+			crop := imaging.Crop(img, focusRect(img.Bounds(), w, h, f))
+			return imaging.Resize(crop, w, h, imaging.Lanczos)
+		}
+	}
+	return s, nil
+}
+
+func parseFit(args []string) (Transform, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, fmt.Errorf("expected a width, height and optional background color")
+	}
+	w, h, err := parseSize(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	o := Options{}
+	if len(args) == 3 {
+		if o.Background, err = ParseColor(args[2]); err != nil {
+			return nil, err
+		}
+	}
+	bg := o.background()
+	return sizeStep{
+		step: step{
+			key: fmt.Sprintf("fit,%d,%d,%s", w, h, colorHex(bg)),
+			apply: func(img image.Image) image.Image {
+				return fit(img, w, h, bg)
+			},
+		},
+		w: w,
+		h: h,
+	}, nil
+}
+
+func parseCrop(args []string) (Transform, error) {
+	if len(args) != 4 {
+		return nil, fmt.Errorf("expected x, y, width and height")
+	}
+	n := [4]int{}
+	for i, arg := range args {
+		v, err := parseInt(arg, 0, MaxSize)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = v
+	}
+	if n[2] == 0 || n[3] == 0 {
+		return nil, fmt.Errorf("width and height must be at least 1")
+	}
+	return step{
+		key: fmt.Sprintf("crop,%d,%d,%d,%d", n[0], n[1], n[2], n[3]),
+		apply: func(img image.Image) image.Image {
+			b := img.Bounds()
+			r := image.Rect(n[0], n[1], n[0]+n[2], n[1]+n[3]).Add(b.Min).Intersect(b)
+			if r.Empty() {
+				// nothing of the image is left, keep it rather than
+				// serving an empty rendition
+				return img
+			}
+			return imaging.Crop(img, r)
+		},
+	}, nil
+}
+
+func parseRotate(args []string) (Transform, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected an angle")
+	}
+	deg, err := strconv.Atoi(args[0])
+	if err != nil || deg%90 != 0 {
+		return nil, fmt.Errorf("angle %q must be a multiple of 90", args[0])
+	}
+	deg = ((deg % 360) + 360) % 360
+	rotations := map[int]func(image.Image) *image.NRGBA{
+		90:  imaging.Rotate90,
+		180: imaging.Rotate180,
+		270: imaging.Rotate270,
+	}
+	return step{
+		key: fmt.Sprintf("rotate,%d", deg),
+		apply: func(img image.Image) image.Image {
+			if rotate, ok := rotations[deg]; ok {
+				return rotate(img)
+			}
+			return img
+		},
+	}, nil
+}
+
+func parseFlip(args []string) (Transform, error) {
+	if len(args) != 1 || (args[0] != "h" && args[0] != "v") {
+		return nil, fmt.Errorf("expected h or v")
+	}
+	flip := imaging.FlipH
+	if args[0] == "v" {
+		flip = imaging.FlipV
+	}
+	return step{
+		key: "flip," + args[0],
+		apply: func(img image.Image) image.Image {
+			return flip(img)
+		},
+	}, nil
+}
+
+// parseSigma parses steps that take a sigma, such as blur,2.
+func parseSigma(name string, fn func(image.Image, float64) *image.NRGBA) TransformParser {
+	return func(args []string) (Transform, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("expected a sigma")
+		}
+		sigma, err := strconv.ParseFloat(args[0], 64)
+		if err != nil || !(sigma > 0 && sigma <= 20) {
+			return nil, fmt.Errorf("sigma %q must be a number above 0 and up to 20", args[0])
+		}
+		return step{
+			key: name + "," + strconv.FormatFloat(sigma, 'f', -1, 64),
+			apply: func(img image.Image) image.Image {
+				return fn(img, sigma)
+			},
+		}, nil
+	}
+}
+
+// parseFixed parses steps that take no arguments.
+func parseFixed(name string, fn func(image.Image) *image.NRGBA) TransformParser {
+	return func(args []string) (Transform, error) {
+		if len(args) != 0 {
+			return nil, fmt.Errorf("expected no arguments")
+		}
+		return step{
+			key: name,
+			apply: func(img image.Image) image.Image {
+				return fn(img)
+			},
+		}, nil
+	}
+}
+
+// kernels are the named 3x3 kernels accepted by convolve.
+var kernels = map[string][9]float64{
+	"emboss":  {-1, -1, 0, -1, 1, 1, 0, 1, 1},
+	"edges":   {-1, -1, -1, -1, 8, -1, -1, -1, -1},
+	"sharpen": {0, -1, 0, -1, 5, -1, 0, -1, 0},
+}
+
+func parseConvolve(args []string) (Transform, error) {
+	var kernel [9]float64
+	var key string
+	switch len(args) {
+	case 1:
+		k, ok := kernels[args[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown kernel %q, expected emboss, edges, sharpen or 9 numbers", args[0])
+		}
+		kernel, key = k, "convolve,"+args[0]
+	case 9:
+		parts := make([]string, 9)
+		for i, arg := range args {
+			v, err := strconv.ParseFloat(arg, 64)
+			if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+				return nil, fmt.Errorf("kernel value %q isn't a number", arg)
+			}
+			kernel[i] = v
+			parts[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		key = "convolve," + strings.Join(parts, ",")
+	default:
+		return nil, fmt.Errorf("expected a kernel name or 9 numbers")
+	}
+	return step{
+		key: key,
+		apply: func(img image.Image) image.Image {
+			return imaging.Convolve3x3(img, kernel, nil)
+		},
+	}, nil
+}
+
+// parseFilterFlag and parseFilterLevel expose the Filters as steps, with the
+// same names and ranges as their query parameters.
+func parseFilterFlag(name string) TransformParser {
+	return func(args []string) (Transform, error) {
+		if len(args) != 0 {
+			return nil, fmt.Errorf("expected no arguments")
+		}
+		return ParseFilters(map[string][]string{name: {""}})
+	}
+}
+
+func parseFilterLevel(name string) TransformParser {
+	return func(args []string) (Transform, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("expected a value")
+		}
+		return ParseFilters(map[string][]string{name: args})
+	}
+}
+
+func parseSize(w string, h string) (int, int, error) {
+	width, err := parseInt(w, 1, MaxSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	height, err := parseInt(h, 1, MaxSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	return width, height, nil
+}
+
+func parseInt(s string, min int, max int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("%q must be a whole number between %d and %d", s, min, max)
+	}
+	return n, nil
+}
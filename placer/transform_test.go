@@ -0,0 +1,124 @@
+package placer
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePipeline(t *testing.T) {
+	tt := []struct {
+		steps []string
+		key   string
+		err   string
+	}{
+		{steps: []string{"fill,300,200", "rotate,90", "blur,2", "sharpen,1"}, key: "fill,300,200,center+rotate,90+blur,2+sharpen,1"},
+		{steps: []string{"resize,400,300", "rotate,-90", "blur,2.0", "", "flip,h"}, key: "resize,400,300+rotate,270+blur,2+flip,h"},
+		{steps: []string{"fit,300,200,navy", "crop,0,0,100,50", "invert"}, key: "fit,300,200,000080+crop,0,0,100,50+invert"},
+		{steps: []string{"resize,300,0", "grayscale", "brightness,-20"}, key: "resize,300,0+gray+bright-20"},
+		{steps: []string{"fill,300,200", "convolve,emboss", "convolve,0,-1,0,-1,5,-1,0,-1,0.0"}, key: "fill,300,200,center+convolve,emboss+convolve,0,-1,0,-1,5,-1,0,-1,0"},
+		{steps: []string{"squash,2"}, err: `unknown step "squash"`},
+		{steps: []string{"rotate,45"}, err: `invalid rotate step "rotate,45": angle "45" must be a multiple of 90`},
+		{steps: []string{"fill,300"}, err: `invalid fill step "fill,300": expected a width, height and optional anchor`},
+		{steps: []string{"fill,300,0"}, err: `"0" must be a whole number between 1 and 8000`},
+		{steps: []string{"blur,0"}, err: `sigma "0" must be a number above 0 and up to 20`},
+		{steps: []string{"flip,x"}, err: `expected h or v`},
+		{steps: []string{"convolve,1,2"}, err: `expected a kernel name or 9 numbers`},
+		{steps: []string{"contrast,500"}, err: `invalid contrast "500"`},
+		{steps: []string{"invert,now"}, err: `expected no arguments`},
+		{steps: []string{"blur,2", "resize,300,200"}, err: `the first step must be resize, fill or fit, not "blur,2"`},
+		{steps: append([]string{"fill,300,200"}, strings.Split(strings.Repeat("invert/", 10), "/")...), err: "too many steps, expected at most 10"},
+	}
+	for _, table := range tt {
+		p, err := ParsePipeline(table.steps)
+		if table.err != "" {
+			if assert.NotNil(t, err, "%v", table.steps) {
+				assert.Contains(t, err.Error(), table.err)
+			}
+			continue
+		}
+		assert.Nil(t, err, "%v", table.steps)
+		assert.Equal(t, table.key, p.Key())
+	}
+}
+
+func TestPipelineApply(t *testing.T) {
+	src := imaging.New(400, 300, color.White)
+	p, err := ParsePipeline([]string{"fill,300,200", "rotate,90", "crop,10,10,100,500"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, image.Point{X: 100, Y: 290}, p.Apply(src).Bounds().Size(), "the crop is clipped to the image")
+	w, h := p.size()
+	assert.Equal(t, 300, w)
+	assert.Equal(t, 200, h)
+
+	inverted, err := ParsePipeline([]string{"resize,400,300", "invert"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := color.NRGBAModel.Convert(inverted.Apply(src).At(0, 0)).(color.NRGBA)
+	assert.Equal(t, color.NRGBA{A: 255}, c)
+}
+
+func TestPipelineFocus(t *testing.T) {
+	// white on the right, so a crop around the focal point is all white
+	src := imaging.New(400, 100, color.Black)
+	src = imaging.Paste(src, imaging.New(100, 100, color.White), image.Pt(300, 0))
+	f := &Focus{X: 0.9, Y: 0.5}
+	tt := []struct {
+		step    string
+		focused bool
+	}{
+		{step: "fill,100,100", focused: true},
+		{step: "fill,100,100,center", focused: true},
+		{step: "fill,100,100,left", focused: false},
+		{step: "resize,100,100", focused: false},
+	}
+	for _, table := range tt {
+		p, err := ParsePipeline([]string{table.step, "invert"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, table.focused, p.focus(f) != nil, table.step)
+		if table.focused {
+			img := p.apply(src, f)
+			assert.Equal(t, image.Pt(100, 100), img.Bounds().Size())
+			assert.Equal(t, color.NRGBA{A: 255}, color.NRGBAModel.Convert(img.At(50, 50)), "%s: the white around the focal point should be kept, then inverted", table.step)
+		}
+	}
+
+	p, err := ParsePipeline([]string{"fill,100,100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"t", "fill,100,100,center", "f90x50"}, Options{Transforms: p}.variant(f))
+	assert.Equal(t, []string{"t", "fill,100,100,center"}, Options{Transforms: p}.variant(nil))
+}
+
+type doubler struct{}
+
+func (doubler) Apply(img image.Image) image.Image {
+	b := img.Bounds()
+	return imaging.Resize(img, b.Dx()*2, b.Dy()*2, imaging.Box)
+}
+
+func (doubler) Key() string { return "double" }
+
+func TestRegisterTransform(t *testing.T) {
+	RegisterTransform("double", func(args []string) (Transform, error) {
+		return doubler{}, nil
+	})
+	defer func() {
+		transformsMu.Lock()
+		delete(transforms, "double")
+		transformsMu.Unlock()
+	}()
+	p, err := ParsePipeline([]string{"resize,4,3", "double"})
+	assert.Nil(t, err)
+	assert.Equal(t, image.Point{X: 8, Y: 6}, p.Apply(imaging.New(4, 3, color.White)).Bounds().Size())
+}
@@ -0,0 +1,130 @@
+package placer
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Defaults for the watermark parameters a request or collection leaves out.
+const (
+	defaultWatermarkOpacity = 0.5
+	defaultWatermarkMargin  = 10
+)
+
+// Watermark is an overlay, such as a logo, composited over a rendition.
+type Watermark struct {
+	// Name identifies the overlay in cache names.
+	Name  string
+	Image image.Image
+	// Opacity is between 0 and 1.
+	Opacity  float64
+	Position imaging.Anchor
+	// Margin keeps the overlay that many pixels from the edges, and apart
+	// from its neighbours when tiled.
+	Margin int
+	// Tile repeats the overlay across the whole rendition, ignoring
+	// Position.
+	Tile bool
+}
+
+// LoadWatermark reads an overlay image, usually a PNG with transparency.
+func LoadWatermark(path string) (image.Image, error) {
+	return imaging.Open(path)
+}
+
+// ParseWatermark reads a watermark from query parameters: ?watermark= names
+// one of marks, and ?watermark_opacity=, ?watermark_position=,
+// ?watermark_margin= and ?watermark_tile adjust it. It returns nil when no
+// watermark was asked for.
+func ParseWatermark(q url.Values, marks map[string]image.Image) (*Watermark, error) {
+	name := q.Get("watermark")
+	if name == "" {
+		return nil, nil
+	}
+	img, ok := marks[name]
+	if !ok {
+		names := []string{}
+		for n := range marks {
+			names = append(names, n)
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("unknown watermark %q, none are configured", name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown watermark %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	wm := &Watermark{
+		Name:     name,
+		Image:    img,
+		Opacity:  defaultWatermarkOpacity,
+		Position: imaging.BottomRight,
+		Margin:   defaultWatermarkMargin,
+	}
+	var err error
+	if v := q.Get("watermark_opacity"); v != "" {
+		wm.Opacity, err = strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(wm.Opacity) || wm.Opacity < 0 || wm.Opacity > 1 {
+			return nil, fmt.Errorf("invalid watermark_opacity %q, expected a number between 0 and 1", v)
+		}
+	}
+	if v := q.Get("watermark_position"); v != "" {
+		if wm.Position, err = ParseAnchor(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := q.Get("watermark_margin"); v != "" {
+		if wm.Margin, err = parseInt(v, 0, MaxSize); err != nil {
+			return nil, fmt.Errorf("invalid watermark_margin: %s", err)
+		}
+	}
+	if wm.Tile, err = parseFlag(q, "watermark_tile"); err != nil {
+		return nil, err
+	}
+	return wm, nil
+}
+
+// Apply composites the overlay, making Watermark a Transform. Overlays too
+// large for the rendition are scaled down to fit within the margins.
+func (wm *Watermark) Apply(img image.Image) image.Image {
+	b := img.Bounds()
+	area := b.Inset(wm.Margin)
+	if area.Empty() || wm.Image.Bounds().Empty() {
+		return img
+	}
+	mark := wm.Image
+	if s := mark.Bounds().Size(); s.X > area.Dx() || s.Y > area.Dy() {
+		mark = imaging.Fit(mark, area.Dx(), area.Dy(), imaging.Lanczos)
+	}
+	size := mark.Bounds().Size()
+	if !wm.Tile {
+		return imaging.Overlay(img, mark, anchorRect(area, size, wm.Position).Min, wm.Opacity)
+	}
+
+	// tiles are laid out on one layer, so the rendition is only composited
+	// once
+	layer := image.NewNRGBA(b)
+	for y := area.Min.Y; y < b.Max.Y; y += size.Y + wm.Margin {
+		for x := area.Min.X; x < b.Max.X; x += size.X + wm.Margin {
+			r := image.Rectangle{Min: image.Pt(x, y), Max: image.Pt(x+size.X, y+size.Y)}
+			draw.Draw(layer, r, mark, mark.Bounds().Min, draw.Src)
+		}
+	}
+	return imaging.Overlay(img, layer, b.Min, wm.Opacity)
+}
+
+// Key names the watermark and its settings for cache names.
+func (wm *Watermark) Key() string {
+	position := anchorName(wm.Position)
+	if wm.Tile {
+		position = "tile"
+	}
+	return fmt.Sprintf("wm-%s-%s-%s-m%d", wm.Name, strconv.FormatFloat(wm.Opacity, 'f', -1, 64), position, wm.Margin)
+}
@@ -0,0 +1,84 @@
+package placer
+
+import (
+	"image"
+	"image/color"
+	"net/url"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseWatermark(t *testing.T) {
+	logo := imaging.New(40, 20, color.White)
+	marks := map[string]image.Image{"logo": logo, "placeholder": logo}
+	tt := []struct {
+		query    string
+		expected *Watermark
+		err      string
+	}{
+		{query: "", expected: nil},
+		{query: "watermark_tile", expected: nil},
+		{query: "watermark=logo", expected: &Watermark{Name: "logo", Image: logo, Opacity: 0.5, Position: imaging.BottomRight, Margin: 10}},
+		{
+			query:    "watermark=logo&watermark_opacity=1&watermark_position=top&watermark_margin=0&watermark_tile",
+			expected: &Watermark{Name: "logo", Image: logo, Opacity: 1, Position: imaging.Top, Tile: true},
+		},
+		{query: "watermark=nope", err: `unknown watermark "nope", expected one of logo, placeholder`},
+		{query: "watermark=logo&watermark_opacity=2", err: `invalid watermark_opacity "2", expected a number between 0 and 1`},
+		{query: "watermark=logo&watermark_margin=-1", err: `invalid watermark_margin: "-1" must be a whole number between 0 and 8000`},
+		{query: "watermark=logo&watermark_tile=sure", err: `invalid watermark_tile "sure", expected true or false`},
+	}
+	for _, table := range tt {
+		q, err := url.ParseQuery(table.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wm, err := ParseWatermark(q, marks)
+		if table.err != "" {
+			if assert.NotNil(t, err, table.query) {
+				assert.Equal(t, table.err, err.Error())
+			}
+			continue
+		}
+		assert.Nil(t, err, table.query)
+		assert.Equal(t, table.expected, wm, table.query)
+	}
+
+	_, err := ParseWatermark(url.Values{"watermark": {"logo"}}, nil)
+	assert.EqualError(t, err, `unknown watermark "logo", none are configured`)
+}
+
+func TestWatermarkKey(t *testing.T) {
+	wm := &Watermark{Name: "logo", Opacity: 0.5, Position: imaging.BottomRight, Margin: 10}
+	assert.Equal(t, "wm-logo-0.5-bottom-right-m10", wm.Key())
+	wm.Tile = true
+	assert.Equal(t, "wm-logo-0.5-tile-m10", wm.Key())
+}
+
+func TestWatermarkApply(t *testing.T) {
+	black := color.NRGBA{A: 255}
+	src := imaging.New(100, 80, black)
+	logo := imaging.New(20, 10, color.White)
+
+	img := (&Watermark{Image: logo, Opacity: 1, Position: imaging.BottomRight, Margin: 5}).Apply(src)
+	assert.Equal(t, src.Bounds(), img.Bounds())
+	assert.Equal(t, color.NRGBA{255, 255, 255, 255}, img.At(94, 74), "the logo sits inside the margin")
+	assert.Equal(t, black, img.At(96, 76), "the margin is left alone")
+	assert.Equal(t, black, img.At(74, 74))
+
+	half := (&Watermark{Image: logo, Opacity: 0.5, Position: imaging.TopLeft}).Apply(src)
+	c := half.At(0, 0).(color.NRGBA)
+	assert.True(t, c.R > 120 && c.R < 135, "half opacity should blend, got %v", c)
+
+	tiled := (&Watermark{Image: logo, Opacity: 1, Margin: 5, Tile: true}).Apply(src)
+	for _, p := range []image.Point{{5, 5}, {30, 20}, {55, 35}, {80, 65}} {
+		assert.Equal(t, color.NRGBA{255, 255, 255, 255}, tiled.At(p.X, p.Y), "tile at %v", p)
+	}
+	assert.Equal(t, black, tiled.At(27, 5), "tiles are spaced by the margin")
+
+	big := (&Watermark{Image: imaging.New(400, 100, color.White), Opacity: 1, Margin: 10}).Apply(src)
+	assert.Equal(t, black, big.At(5, 40), "large overlays shrink to fit within the margins")
+	assert.Equal(t, color.NRGBA{255, 255, 255, 255}, big.At(50, 40))
+}
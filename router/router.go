@@ -1,51 +1,103 @@
 package router
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
-	"io/ioutil"
+	"image/color"
+	"io/fs"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 
-	"github.com/disintegration/imaging"
 	"github.com/gorilla/mux"
 	"github.com/mercul3s/placechicken/placer"
 )
 
 // Mux holds the configuration information for an router.
 type Mux struct {
-	Place       placer.Place
+	// Collections are the image libraries served, by name, each under
+	// /c/{collection}/. Default is also served on the unprefixed paths.
+	Collections map[string]placer.Place
+	Default     string
 	Router      *mux.Router
-	staticDir   string
-	templateDir string
+	static      fs.FS
+	templates   fs.FS
 }
 
+// pinned is the Cache-Control header for responses naming an original by ID.
+// The original may still be replaced under the same ID, so they are only
+// cached for a day.
+const pinned = "public, max-age=86400"
+
 // PageData stores information for output in a template.
 type PageData struct {
 	Image string
 }
 
-// NewMux returns a new mux router with all routes defined
-func NewMux(place placer.Place, sDir string, tDir string) Mux {
+// DefaultCollection names the only collection of a mux built by NewMux.
+const DefaultCollection = "default"
+
+// NewMux returns a new mux router with all routes defined, serving a single
+// collection. Static files and templates are read from the given file
+// systems, which may be embedded in the binary or on disk.
+func NewMux(place placer.Place, static fs.FS, templates fs.FS) Mux {
+	return NewCollectionsMux(map[string]placer.Place{DefaultCollection: place}, DefaultCollection, static, templates)
+}
+
+// NewCollectionsMux returns a new mux router serving several named
+// collections, with def served on the paths without a collection prefix.
+func NewCollectionsMux(collections map[string]placer.Place, def string, static fs.FS, templates fs.FS) Mux {
 	r := mux.NewRouter()
 	m := Mux{
-		Place:       place,
+		Collections: collections,
+		Default:     def,
 		Router:      r,
-		staticDir:   sDir,
-		templateDir: tDir,
+		static:      static,
+		templates:   templates,
 	}
 	m.Router.HandleFunc("/", m.index).Methods("GET")
-	m.Router.HandleFunc("/{width}/{height}", m.resizeHandler).Methods("GET")
-	m.Router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir(sDir))))
+	m.Router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.FS(static))))
+	for _, r := range []*mux.Router{m.Router.PathPrefix("/c/{collection}").Subrouter(), m.Router} {
+		r.HandleFunc("/api/images", m.imagesHandler).Methods("GET")
+		r.HandleFunc("/t/{steps:.+}", m.resizeHandler).Methods("GET")
+		r.HandleFunc("/id/{id}/t/{steps:.+}", m.resizeHandler).Methods("GET")
+		r.HandleFunc("/{width}/{height}", m.resizeHandler).Methods("GET")
+		r.HandleFunc("/id/{id}/{width}/{height}", m.resizeHandler).Methods("GET")
+		r.HandleFunc("/g/{width}/{height}", m.grayscaleHandler).Methods("GET")
+		r.HandleFunc("/random/{width}/{height}", m.randomHandler).Methods("GET")
+		// after the fixed prefixes above, so a tag can't shadow them
+		r.HandleFunc("/{tag}/{width:[0-9]+}/{height:[0-9]+}", m.resizeHandler).Methods("GET")
+	}
 	m.Router.NotFoundHandler = http.HandlerFunc(m.eggHandler)
 
 	return m
 }
 
+// collection returns the collection a request is for, along with the path
+// prefix its routes live under. It writes a 404 if there is no such
+// collection.
+func (m Mux) collection(w http.ResponseWriter, r *http.Request) (placer.Place, string, bool) {
+	name, prefix := mux.Vars(r)["collection"], ""
+	if name == "" {
+		name = m.Default
+	} else {
+		prefix = "/c/" + name
+	}
+	place, ok := m.Collections[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unable to process request: unknown collection %q", name), http.StatusNotFound)
+	}
+	return place, prefix, ok
+}
+
 func (m Mux) index(w http.ResponseWriter, r *http.Request) {
-	t := template.Must(template.ParseFiles(m.templateDir + "index.html"))
-	data := PageData{Image: "/605/0"}
-	err := t.Execute(w, data)
+	t, err := template.ParseFS(m.templates, "index.html")
+	if err == nil {
+		err = t.Execute(w, PageData{Image: "/605/0"})
+	}
 	if err != nil {
 		msg := fmt.Sprintf("unable to process request: %s", err.Error())
 		http.Error(w, msg, http.StatusInternalServerError)
@@ -55,31 +107,221 @@ func (m Mux) index(w http.ResponseWriter, r *http.Request) {
 
 func (m Mux) resizeHandler(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
+	var pipeline placer.Pipeline
+	if steps, ok := v["steps"]; ok {
+		// the steps after /t/ give the size instead, e.g. /t/fill,300,200/blur,2
+		var err error
+		pipeline, err = placer.ParsePipeline(strings.Split(steps, "/"))
+		if err == nil && len(pipeline) == 0 {
+			err = errors.New("no transform steps given")
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("unable to process request: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+	var width, height int
+	if pipeline == nil {
+		var ok bool
+		if width, height, ok = size(w, v); !ok {
+			return
+		}
+	}
+	q := r.URL.Query()
+	mode, err := placer.ParseMode(q.Get("mode"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to process request: %s", err), http.StatusBadRequest)
+		return
+	}
+	anchor, err := placer.ParseAnchor(q.Get("anchor"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to process request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	var bg color.Color
+	if v := q.Get("bg"); v != "" {
+		bg, err = placer.ParseColor(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("unable to process request: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	filters, err := placer.ParseFilters(q)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to process request: %s", err), http.StatusBadRequest)
+		return
+	}
+	label, err := placer.ParseLabel(q)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to process request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	place, _, ok := m.collection(w, r)
+	if !ok {
+		return
+	}
+	watermark, err := placer.ParseWatermark(q, place.Watermarks)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to process request: %s", err), http.StatusBadRequest)
+		return
+	}
+	image, err := place.Render(placer.Options{
+		ID:         v["id"],
+		Seed:       q.Get("seed"),
+		Tags:       tags(r),
+		Width:      width,
+		Height:     height,
+		Mode:       mode,
+		Anchor:     anchor,
+		Background: bg,
+		Filters:    filters,
+		Transforms: pipeline,
+		Label:      label,
+		Watermark:  watermark,
+	})
+	if errors.Is(err, placer.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("unable to process request: %s", err), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		msg := fmt.Sprintf("unable to process request: %s", err.Error())
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(image.Data)))
+	switch {
+	case image.Fallback != "":
+		// the originals may be back on the next request
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Placechicken-Fallback", image.Fallback)
+	case v["id"] != "":
+		// an id always names the same original
+		w.Header().Set("Cache-Control", pinned)
+	case q.Get("seed") == "":
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	if image.Upscaled {
+		w.Header().Set("X-Placechicken-Upscaled", fmt.Sprintf("%dx%d", image.Source.Width, image.Source.Height))
+	}
+	if f := image.Source.Focus; f != nil {
+		w.Header().Set("X-Focal-Point", fmt.Sprintf("%.2f,%.2f", f.X, f.Y))
+	}
+	w.Write(image.Data)
+}
+
+// grayscaleHandler serves /g/{width}/{height}, a grayscale image like the
+// ones placekitten serves on the same path.
+func (m Mux) grayscaleHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	q.Set("grayscale", "true")
+	r.URL.RawQuery = q.Encode()
+	m.resizeHandler(w, r)
+}
+
+// randomHandler picks an original and redirects to its canonical URL, which
+// caches can keep.
+func (m Mux) randomHandler(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	q := r.URL.Query()
+	width, height, ok := size(w, v)
+	if !ok {
+		return
+	}
+	place, prefix, ok := m.collection(w, r)
+	if !ok {
+		return
+	}
+	// the size is passed on so the pick prefers originals of that shape
+	// that needn't be scaled up
+	img, err := place.Pick(placer.Options{Seed: q.Get("seed"), Tags: tags(r), Width: width, Height: height})
+	if err == nil && img.ID == "" {
+		err = placer.ErrNotFound
+	}
+	if err != nil && place.Fallback != nil {
+		// there is nothing to redirect to, serve whatever rendering the
+		// request falls back to
+		m.resizeHandler(w, r)
+		return
+	}
+	if errors.Is(err, placer.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("unable to process request: %s", err), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		msg := fmt.Sprintf("unable to process request: %s", err.Error())
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	q.Del("seed")
+	q.Del("tag")
+	u := url.URL{
+		Path:     prefix + "/id/" + img.ID + "/" + v["width"] + "/" + v["height"],
+		RawQuery: q.Encode(),
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// size reads the width and height of a request, writing a 400 if they
+// aren't whole numbers up to placer.MaxSize.
+func size(w http.ResponseWriter, v map[string]string) (int, int, bool) {
 	width, wErr := strconv.Atoi(v["width"])
 	height, hErr := strconv.Atoi(v["height"])
-	if wErr != nil && hErr != nil {
-		msg := fmt.Sprintf("unable to process request: must provide width or height")
-		http.Error(w, msg, http.StatusBadRequest)
+	if wErr != nil || hErr != nil || width < 0 || height < 0 {
+		http.Error(w, "unable to process request: width and height must be whole numbers", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	if width > placer.MaxSize || height > placer.MaxSize {
+		http.Error(w, fmt.Sprintf("unable to process request: width and height can't be over %d", placer.MaxSize), http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return width, height, true
+}
+
+// imagesHandler lists the originals in the library, with their metadata, as
+// json.
+func (m Mux) imagesHandler(w http.ResponseWriter, r *http.Request) {
+	place, _, ok := m.collection(w, r)
+	if !ok {
 		return
 	}
-	image, err := m.Place.GetImage(width, height)
+	lib, err := place.Dir.Library(place.OriginalFilePath)
 	if err != nil {
 		msg := fmt.Sprintf("unable to process request: %s", err.Error())
 		http.Error(w, msg, http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lib.Tagged(tags(r)...))
+}
 
-	w.Header().Set("Content-Type", "image/jpeg")
-	imaging.Encode(w, image, imaging.JPEG)
+// tags collects the tags a request filters on, from the path and from a
+// comma separated ?tag= parameter.
+func tags(r *http.Request) []string {
+	t := []string{}
+	if tag := mux.Vars(r)["tag"]; tag != "" {
+		t = append(t, tag)
+	}
+	for _, tag := range strings.Split(r.URL.Query().Get("tag"), ",") {
+		if tag != "" {
+			t = append(t, tag)
+		}
+	}
+	return t
 }
 
 func (m Mux) eggHandler(w http.ResponseWriter, r *http.Request) {
-	chicken, err := ioutil.ReadFile(m.templateDir + "chicken")
+	chicken, err := fs.ReadFile(m.templates, "chicken")
 	if err != nil {
 		msg := fmt.Sprintf("error reading file: %s", err)
 		http.Error(w, msg, http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusNotFound)
-	fmt.Fprintf(w, string(chicken))
+	fmt.Fprint(w, string(chicken))
 }
@@ -1,12 +1,16 @@
 package router
 
 import (
+	"encoding/json"
 	"errors"
+	"image"
+	"image/color"
 	"io/ioutil"
 	"net/http/httptest"
 	"os"
 	"testing"
 
+	"github.com/disintegration/imaging"
 	"github.com/mercul3s/placechicken/placer"
 	"github.com/stretchr/testify/assert"
 )
@@ -25,7 +29,7 @@ func TestRouter(t *testing.T) {
 		ResizedFilePath:  "/tmp/placechicken/",
 	}
 
-	r := NewMux(p, "../static/", "../templates/")
+	r := NewMux(p, os.DirFS("../static"), os.DirFS("../templates"))
 
 	tt := []struct {
 		name           string
@@ -110,6 +114,120 @@ func TestImageRoute(t *testing.T) {
 			expectedHeader: []string{"text/plain; charset=utf-8"},
 			expectedError:  errors.New("this is an error"),
 		},
+		{
+			name:           "expect GET with an explicit mode and anchor to return a resized image",
+			route:          "/300/500?mode=stretch&anchor=top-left",
+			expectedStatus: 200,
+			expectedHeader: []string{"image/jpeg"},
+		},
+		{
+			name:           "expect GET with an unknown mode to be rejected",
+			route:          "/300/500?mode=squash",
+			expectedStatus: 400,
+			expectedHeader: []string{"text/plain; charset=utf-8"},
+		},
+		{
+			name:           "expect GET with a non-numeric width to be rejected",
+			route:          "/abc/300",
+			expectedStatus: 400,
+			expectedHeader: []string{"text/plain; charset=utf-8"},
+		},
+		{
+			name:           "expect GET with an oversized width to be rejected",
+			route:          "/8001/500",
+			expectedStatus: 400,
+			expectedHeader: []string{"text/plain; charset=utf-8"},
+		},
+		{
+			name:           "expect GET for an oversized id route to be rejected",
+			route:          "/id/abc123/300/9000",
+			expectedStatus: 400,
+			expectedHeader: []string{"text/plain; charset=utf-8"},
+		},
+		{
+			name:           "expect GET to fit the image on a background color",
+			route:          "/300/500?mode=fit&bg=papayawhip",
+			expectedStatus: 200,
+			expectedHeader: []string{"image/jpeg"},
+		},
+		{
+			name:           "expect GET to smart crop the image",
+			route:          "/300/500?mode=smart",
+			expectedStatus: 200,
+			expectedHeader: []string{"image/jpeg"},
+		},
+		{
+			name:           "expect GET with an invalid background color to be rejected",
+			route:          "/300/500?mode=fit&bg=nope",
+			expectedStatus: 400,
+			expectedHeader: []string{"text/plain; charset=utf-8"},
+		},
+		{
+			name:           "expect GET to '/g/{width}/{height}' to return a grayscale image",
+			route:          "/g/300/500",
+			expectedStatus: 200,
+			expectedHeader: []string{"image/jpeg"},
+		},
+		{
+			name:           "expect GET with filters to return a filtered image",
+			route:          "/300/500?blur=3&brightness=-20&sepia",
+			expectedStatus: 200,
+			expectedHeader: []string{"image/jpeg"},
+		},
+		{
+			name:           "expect GET with an out of range filter to be rejected",
+			route:          "/300/500?contrast=500",
+			expectedStatus: 400,
+			expectedHeader: []string{"text/plain; charset=utf-8"},
+		},
+		{
+			name:           "expect GET with a label to draw the dimensions",
+			route:          "/300/500?label&label_position=bottom-right&label_color=yellow",
+			expectedStatus: 200,
+			expectedHeader: []string{"image/jpeg"},
+		},
+		{
+			name:           "expect GET with text to draw it on a backdrop",
+			route:          "/300/500?text=hello&label_style=backdrop",
+			expectedStatus: 200,
+			expectedHeader: []string{"image/jpeg"},
+		},
+		{
+			name:           "expect GET with an unknown label style to be rejected",
+			route:          "/300/500?label&label_style=shadow",
+			expectedStatus: 400,
+			expectedHeader: []string{"text/plain; charset=utf-8"},
+		},
+		{
+			name:           "expect GET with a watermark to composite it",
+			route:          "/300/500?watermark=logo&watermark_opacity=0.3&watermark_tile",
+			expectedStatus: 200,
+			expectedHeader: []string{"image/jpeg"},
+		},
+		{
+			name:           "expect GET with an unknown watermark to be rejected",
+			route:          "/300/500?watermark=nope",
+			expectedStatus: 400,
+			expectedHeader: []string{"text/plain; charset=utf-8"},
+		},
+		{
+			name:           "expect GET to '/t/{steps}' to return a transformed image",
+			route:          "/t/fill,300,200/rotate,90/blur,2/sharpen,1",
+			expectedStatus: 200,
+			expectedHeader: []string{"image/jpeg"},
+		},
+		{
+			name:           "expect GET with an invalid transform step to be rejected",
+			route:          "/t/fill,300,200/rotate,45",
+			expectedStatus: 400,
+			expectedHeader: []string{"text/plain; charset=utf-8"},
+		},
+		{
+			name:           "expect GET with an unknown anchor to be rejected",
+			route:          "/300/500?anchor=middle",
+			expectedStatus: 400,
+			expectedHeader: []string{"text/plain; charset=utf-8"},
+		},
 	}
 	for _, test := range tt {
 		t.Run(test.name, func(t *testing.T) {
@@ -126,11 +244,20 @@ func TestImageRoute(t *testing.T) {
 				Dir:              d,
 				OriginalFilePath: "../static/images/test/",
 				ResizedFilePath:  "/tmp/placechicken/",
+				Watermarks:       map[string]image.Image{"logo": imaging.New(40, 20, color.White)},
 			}
 
 			d.On("List", "../static/images/test/").Return(fileList, test.expectedError)
-			d.On("RandImg", "../static/images/test/").Return(file, test.expectedError)
-			r := NewMux(p, "../static/", "../templates/")
+			lib := placer.MockLibrary("../static/images/test/", file)
+			file = lib.Images()[0]
+			d.On("Library", "../static/images/test/").Return(lib, test.expectedError)
+			f, err := os.Open("../static/images/test/original-test-image.jpg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			d.On("Open", "../static/images/test/", file).Return(f, nil)
+			r := NewMux(p, os.DirFS("../static"), os.DirFS("../templates"))
 			req := httptest.NewRequest("GET", test.route, nil)
 			rr := httptest.NewRecorder()
 			r.Router.ServeHTTP(rr, req)
@@ -143,3 +270,333 @@ func TestImageRoute(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestImagesAPI(t *testing.T) {
+	focus := &placer.Focus{X: 0.25, Y: 0.5}
+	file := placer.Image{Name: "original-test-image.jpg", Focus: focus}
+	lib := placer.NewLibrary("../static/images/test/", func(string) ([]placer.Image, error) {
+		return []placer.Image{file}, nil
+	})
+	if err := lib.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	file = lib.Images()[0]
+	d := &placer.MockDir{}
+	d.On("Library", "../static/images/test/").Return(lib, nil)
+	d.On("Open", "../static/images/test/", file).Return(placer.MockOpen("../static/images/test/original-test-image.jpg"), nil)
+	p := placer.Place{
+		Dir:              d,
+		OriginalFilePath: "../static/images/test/",
+	}
+	r := NewMux(p, os.DirFS("../static"), os.DirFS("../templates"))
+
+	req := httptest.NewRequest("GET", "/api/images", nil)
+	rr := httptest.NewRecorder()
+	r.Router.ServeHTTP(rr, req)
+	assert.Equal(t, 200, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	var images []placer.Image
+	assert.Nil(t, json.NewDecoder(rr.Body).Decode(&images))
+	assert.Equal(t, lib.Images(), images)
+	assert.Equal(t, focus, images[0].Focus)
+
+	req = httptest.NewRequest("GET", "/300/500", nil)
+	rr = httptest.NewRecorder()
+	r.Router.ServeHTTP(rr, req)
+	assert.Equal(t, 200, rr.Code)
+	assert.Equal(t, "0.25,0.50", rr.Header().Get("X-Focal-Point"))
+}
+
+func TestDeterministicRoutes(t *testing.T) {
+	lib := placer.NewLibrary("../static/images/test/", func(string) ([]placer.Image, error) {
+		return []placer.Image{{Name: "original-test-image.jpg", Width: 2160, Height: 1440}}, nil
+	})
+	if err := lib.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	file := lib.Images()[0]
+	d := &placer.MockDir{}
+	d.On("Library", "../static/images/test/").Return(lib, nil)
+	d.On("Open", "../static/images/test/", file).Return(placer.MockOpen("../static/images/test/original-test-image.jpg"), nil)
+	p := placer.Place{
+		Dir:              d,
+		OriginalFilePath: "../static/images/test/",
+	}
+	r := NewMux(p, os.DirFS("../static"), os.DirFS("../templates"))
+
+	tt := []struct {
+		name             string
+		route            string
+		expectedStatus   int
+		expectedCache    string
+		expectedUpscaled string
+	}{
+		{
+			name:           "expect GET to '/id/{id}/{width}/{height}' to return that image",
+			route:          "/id/" + file.ID + "/300/200",
+			expectedStatus: 200,
+			expectedCache:  "public, max-age=86400",
+		},
+		{
+			name:             "expect GET larger than the original to note the upscale",
+			route:            "/id/" + file.ID + "/3000/2000",
+			expectedStatus:   200,
+			expectedCache:    "public, max-age=86400",
+			expectedUpscaled: "2160x1440",
+		},
+		{
+			name:           "expect GET with an unknown id to return 404",
+			route:          "/id/bogus/300/200",
+			expectedStatus: 404,
+		},
+		{
+			name:           "expect GET with a seed to return an image",
+			route:          "/300/200?seed=regression",
+			expectedStatus: 200,
+		},
+	}
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", test.route, nil)
+			rr := httptest.NewRecorder()
+			r.Router.ServeHTTP(rr, req)
+			assert.Equal(t, test.expectedStatus, rr.Code, test.name)
+			assert.Equal(t, test.expectedCache, rr.Header().Get("Cache-Control"), test.name)
+			assert.Equal(t, test.expectedUpscaled, rr.Header().Get("X-Placechicken-Upscaled"), test.name)
+		})
+	}
+}
+
+func TestRandomRedirect(t *testing.T) {
+	lib := placer.MockLibrary("../static/images/test/", placer.Image{Name: "original-test-image.jpg"})
+	file := lib.Images()[0]
+	d := &placer.MockDir{}
+	d.On("Library", "../static/images/test/").Return(lib, nil)
+	d.On("Open", "../static/images/test/", file).Return(placer.MockOpen("../static/images/test/original-test-image.jpg"), nil)
+	p := placer.Place{
+		Dir:              d,
+		OriginalFilePath: "../static/images/test/",
+	}
+	r := NewMux(p, os.DirFS("../static"), os.DirFS("../templates"))
+
+	req := httptest.NewRequest("GET", "/random/300/200?mode=smart", nil)
+	rr := httptest.NewRecorder()
+	r.Router.ServeHTTP(rr, req)
+	assert.Equal(t, 302, rr.Code)
+	assert.Equal(t, "/id/"+file.ID+"/300/200?mode=smart", rr.Header().Get("Location"))
+	assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+
+	req = httptest.NewRequest("GET", "/300/200", nil)
+	rr = httptest.NewRecorder()
+	r.Router.ServeHTTP(rr, req)
+	assert.Equal(t, 200, rr.Code)
+	assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"), "random images can't be cached")
+
+	empty := &placer.MockDir{}
+	empty.On("Library", "../static/images/test/").Return(placer.MockLibrary("../static/images/test/"), nil)
+	p.Dir = empty
+	r = NewMux(p, os.DirFS("../static"), os.DirFS("../templates"))
+	req = httptest.NewRequest("GET", "/random/300/200", nil)
+	rr = httptest.NewRecorder()
+	r.Router.ServeHTTP(rr, req)
+	assert.Equal(t, 404, rr.Code, "an empty library has nothing to redirect to")
+
+	for _, route := range []string{"/random/wide/200", "/random/300/-1", "/random/8001/200"} {
+		rr = httptest.NewRecorder()
+		r.Router.ServeHTTP(rr, httptest.NewRequest("GET", route, nil))
+		assert.Equal(t, 400, rr.Code, route)
+	}
+
+	shaped := placer.NewLibrary("../static/images/test/", func(string) ([]placer.Image, error) {
+		return []placer.Image{
+			{Name: "tall/original-test-image.jpg", Width: 200, Height: 600},
+			{Name: "wide/original-test-image.jpg", Width: 600, Height: 200},
+			{Name: "small/original-test-image.jpg", Width: 90, Height: 30},
+		}, nil
+	})
+	if err := shaped.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	wide := shaped.Images()[2]
+	d = &placer.MockDir{}
+	d.On("Library", "../static/images/test/").Return(shaped, nil)
+	p.Dir = d
+	r = NewMux(p, os.DirFS("../static"), os.DirFS("../templates"))
+	for i := 0; i < 10; i++ {
+		rr = httptest.NewRecorder()
+		r.Router.ServeHTTP(rr, httptest.NewRequest("GET", "/random/300/100", nil))
+		assert.Equal(t, "/id/"+wide.ID+"/300/100", rr.Header().Get("Location"), "the pick should match the requested shape without upscaling")
+	}
+}
+
+func TestTagRoutes(t *testing.T) {
+	lib := placer.NewLibrary("../static/images/test/", func(string) ([]placer.Image, error) {
+		return []placer.Image{
+			{Name: "original-test-image.jpg", Tags: []string{"chicks"}},
+			{Name: "roosters/original-test-image.jpg", Tags: []string{"roosters"}},
+		}, nil
+	})
+	if err := lib.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	d := &placer.MockDir{}
+	d.On("Library", "../static/images/test/").Return(lib, nil)
+	d.On("Open", "../static/images/test/", lib.Images()[0]).Return(placer.MockOpen("../static/images/test/original-test-image.jpg"), nil)
+	p := placer.Place{
+		Dir:              d,
+		OriginalFilePath: "../static/images/test/",
+	}
+	r := NewMux(p, os.DirFS("../static"), os.DirFS("../templates"))
+
+	tt := []struct {
+		name           string
+		route          string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "expect GET to '/{tag}/{width}/{height}' to return a tagged image",
+			route:          "/chicks/300/200",
+			expectedStatus: 200,
+		},
+		{
+			name:           "expect GET with a tag parameter to return a tagged image",
+			route:          "/300/200?tag=chicks",
+			expectedStatus: 200,
+		},
+		{
+			name:           "expect GET with an unknown tag to return 404",
+			route:          "/ducks/300/200",
+			expectedStatus: 404,
+			expectedBody:   "no matching image tagged ducks",
+		},
+		{
+			name:           "expect GET with tags no image carries together to return 404",
+			route:          "/chicks/300/200?tag=roosters",
+			expectedStatus: 404,
+			expectedBody:   "no matching image tagged chicks, roosters",
+		},
+		{
+			name:           "expect static files to be served rather than tags",
+			route:          "/static/css/main.css",
+			expectedStatus: 200,
+		},
+	}
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", test.route, nil)
+			rr := httptest.NewRecorder()
+			r.Router.ServeHTTP(rr, req)
+			assert.Equal(t, test.expectedStatus, rr.Code, test.name)
+			assert.Contains(t, rr.Body.String(), test.expectedBody)
+		})
+	}
+
+	req := httptest.NewRequest("GET", "/api/images?tag=roosters", nil)
+	rr := httptest.NewRecorder()
+	r.Router.ServeHTTP(rr, req)
+	var images []placer.Image
+	assert.Nil(t, json.NewDecoder(rr.Body).Decode(&images))
+	if assert.Equal(t, 1, len(images)) {
+		assert.Equal(t, "roosters/original-test-image.jpg", images[0].Name)
+	}
+}
+
+func TestCollectionRoutes(t *testing.T) {
+	places := map[string]placer.Place{}
+	dirs := map[string]*placer.MockDir{}
+	var id string
+	for _, name := range []string{"chickens", "ducks"} {
+		lib := placer.NewLibrary(name, func(string) ([]placer.Image, error) {
+			return []placer.Image{{Name: "original-test-image.jpg"}}, nil
+		})
+		if err := lib.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		d := &placer.MockDir{}
+		d.On("Library", name).Return(lib, nil)
+		d.On("Open", name, lib.Images()[0]).Return(placer.MockOpen("../static/images/test/original-test-image.jpg"), nil)
+		places[name] = placer.Place{Dir: d, OriginalFilePath: name}
+		dirs[name] = d
+		id = lib.Images()[0].ID
+	}
+	r := NewCollectionsMux(places, "chickens", os.DirFS("../static"), os.DirFS("../templates"))
+
+	tt := []struct {
+		name             string
+		route            string
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{
+			name:           "expect GET to '/c/{collection}/{width}/{height}' to return an image",
+			route:          "/c/ducks/300/200",
+			expectedStatus: 200,
+		},
+		{
+			name:           "expect GET to the unprefixed paths to use the default collection",
+			route:          "/300/200",
+			expectedStatus: 200,
+		},
+		{
+			name:             "expect GET to a collection's random route to redirect within the collection",
+			route:            "/c/ducks/random/300/200",
+			expectedStatus:   302,
+			expectedLocation: "/c/ducks/id/" + id + "/300/200",
+		},
+		{
+			name:           "expect GET to an unknown collection to return 404",
+			route:          "/c/geese/300/200",
+			expectedStatus: 404,
+		},
+	}
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", test.route, nil)
+			rr := httptest.NewRecorder()
+			r.Router.ServeHTTP(rr, req)
+			assert.Equal(t, test.expectedStatus, rr.Code, test.name)
+			assert.Equal(t, test.expectedLocation, rr.Header().Get("Location"), test.name)
+		})
+	}
+	dirs["ducks"].AssertNumberOfCalls(t, "Open", 1)
+	dirs["chickens"].AssertNumberOfCalls(t, "Open", 1)
+}
+
+func TestFallbackRoutes(t *testing.T) {
+	empty := &placer.MockDir{}
+	empty.On("Library", "../static/images/test/").Return(placer.MockLibrary("../static/images/test/"), nil)
+	down := &placer.MockDir{}
+	down.On("Library", "../static/images/test/").Return((*placer.Library)(nil), errors.New("backend down"))
+
+	tt := []struct {
+		name     string
+		dir      placer.Directory
+		route    string
+		status   int
+		fallback string
+	}{
+		{name: "an empty library falls back", dir: empty, route: "/300/200", status: 200, fallback: placer.FallbackEmpty},
+		{name: "random picks fall back too", dir: empty, route: "/random/300/200", status: 200, fallback: placer.FallbackEmpty},
+		{name: "missing tags are still not found", dir: empty, route: "/ducks/300/200", status: 404},
+		{name: "missing ids are still not found", dir: empty, route: "/id/bogus/300/200", status: 404},
+		{name: "an unreachable backend falls back", dir: down, route: "/id/bogus/300/200", status: 200, fallback: placer.FallbackUnavailable},
+	}
+	for _, table := range tt {
+		p := placer.Place{
+			Dir:              table.dir,
+			OriginalFilePath: "../static/images/test/",
+			Fallback:         placer.DefaultFallback,
+		}
+		r := NewMux(p, os.DirFS("../static"), os.DirFS("../templates"))
+		req := httptest.NewRequest("GET", table.route, nil)
+		rr := httptest.NewRecorder()
+		r.Router.ServeHTTP(rr, req)
+		assert.Equal(t, table.status, rr.Code, table.name)
+		assert.Equal(t, table.fallback, rr.Header().Get("X-Placechicken-Fallback"), table.name)
+		if table.fallback != "" {
+			assert.Equal(t, "image/jpeg", rr.Header().Get("Content-Type"), table.name)
+			assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"), "%s: fallbacks can't be cached", table.name)
+		}
+	}
+}